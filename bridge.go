@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// Characters not allowed in a level of an MQTT topic name
+var bridgeEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// bridgeMessage is the payload of a republished sample.
+type bridgeMessage struct {
+	Value  float64           `json:"value"`
+	Labels map[string]string `json:"labels"`
+	Ts     int64             `json:"ts"`
+}
+
+// bridgeWriter republishes the samples to the MQTT broker.
+type bridgeWriter struct {
+	cfg config.ExporterBridgeConfig
+}
+
+// startBridge adds a sink republishing the samples to the MQTT broker of the
+// exporter, so that other consumers can reuse the normalization done by the
+// filters.
+func startBridge(cfg config.ExporterBridgeConfig) {
+	w := &bridgeWriter{cfg: cfg}
+	log.Infof("Republishing samples to %s", cfg.TopicPrefix)
+	sampleSinks = append(sampleSinks, newBatchSink("bridge", cfg.BatchSize, cfg.FlushInterval, w.write))
+}
+
+// topic returns the topic of a sample: the topic prefix, the metric name and
+// the values of the topic labels.
+func (w *bridgeWriter) topic(name string, labels map[string]string) string {
+	levels := []string{bridgeEscaper.Replace(name)}
+	for _, label := range w.cfg.TopicLabels {
+		value := labels[label]
+		if value == "" {
+			value = "_"
+		}
+		levels = append(levels, bridgeEscaper.Replace(value))
+	}
+	return w.cfg.TopicPrefix + strings.Join(levels, "/")
+}
+
+func (w *bridgeWriter) write(samples []timedSample) error {
+	if mqttClient == nil || !mqttClient.IsConnectionOpen() {
+		return errors.New("not connected to the MQTT broker")
+	}
+	var err error
+	var topics []string
+	var tokens []mqtt.Token
+	for _, v := range samples {
+		sample := v.sample
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		payload, e := json.Marshal(bridgeMessage{Value: sample.Value, Labels: sample.Labels, Ts: v.received.UnixMilli()})
+		if e != nil {
+			err = e
+			continue
+		}
+		topic := w.topic(sample.Name, sample.Labels)
+		topics = append(topics, topic)
+		tokens = append(tokens, mqttClient.Publish(topic, w.cfg.Qos, w.cfg.Retain, payload))
+	}
+	// The acknowledgements of the batch are waited for together
+	for i, token := range tokens {
+		if !token.WaitTimeout(w.cfg.Timeout) {
+			err = fmt.Errorf("publication to %s timed out", topics[i])
+		} else if token.Error() != nil {
+			err = token.Error()
+		}
+	}
+	return err
+}
@@ -0,0 +1,487 @@
+// Package collector stores the decoded samples until they expire and exposes
+// them as a prometheus.Collector.
+package collector
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+var (
+	DroppedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_samples_dropped_total",
+			Help: "Number of samples dropped because the sample buffer was full.",
+		},
+	)
+	EvictedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_samples_evicted_total",
+			Help: "Number of samples evicted because the maximum number of samples was reached.",
+		},
+	)
+	RejectedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_samples_rejected_total",
+			Help: "Number of new samples rejected because the maximum number of samples was reached.",
+		},
+	)
+)
+
+type Sample struct {
+	Id      string
+	Name    string
+	Labels  map[string]string
+	Help    string
+	Value   float64
+	DType   string
+	Dstype  string
+	Time    float64
+	Type    prometheus.ValueType
+	Unit    string
+	Expires time.Time
+
+	// Timestamp is the time found in the payload, zero when the filter does
+	// not define one
+	Timestamp time.Time
+	// Topic of the message the sample was decoded from
+	Topic string
+	// Tenant whose samples are only exposed on their own metrics path, empty
+	// for the samples exposed by the collector
+	Tenant string
+	// Filter the sample was decoded by
+	Filter string
+	// Group is the metric group of the sample
+	Group string
+	// Histogram of a histogram sample, whose Value is the sum
+	Histogram *Histogram
+
+	desc *prometheus.Desc
+}
+
+// Number of shards of the sample store. Samples are spread over the shards by
+// id so that storing samples and scraping do not contend on a single lock.
+const sampleStoreShards = 64
+
+type sampleShard struct {
+	mu      sync.RWMutex
+	samples map[string]*Sample
+	// expiries of the stored samples, including the stale entries of the
+	// samples deleted or stored again since
+	expiries expiryHeap
+}
+
+// expiry is the expiry of a stored sample.
+type expiry struct {
+	id      string
+	expires time.Time
+}
+
+// expiryHeap is a min-heap of expiries implementing heap.Interface.
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// track records the expiry of a stored sample. The heap is rebuilt from the
+// stored samples when the stale entries prevail.
+func (s *sampleShard) track(sample *Sample) {
+	heap.Push(&s.expiries, expiry{sample.Id, sample.Expires})
+	if len(s.expiries) > 2*len(s.samples)+16 {
+		s.expiries = s.expiries[:0]
+		for id, sample := range s.samples {
+			s.expiries = append(s.expiries, expiry{id, sample.Expires})
+		}
+		heap.Init(&s.expiries)
+	}
+}
+
+// soonest returns the expiry of the stored sample expiring the soonest,
+// popping the stale entries.
+func (s *sampleShard) soonest() (expiry, bool) {
+	for len(s.expiries) > 0 {
+		e := s.expiries[0]
+		if sample, ok := s.samples[e.id]; ok && sample.Expires.Equal(e.expires) {
+			return e, true
+		}
+		heap.Pop(&s.expiries)
+	}
+	return expiry{}, false
+}
+
+// purge deletes the samples expired at the given time and returns their
+// number.
+func (s *sampleShard) purge(now time.Time) int {
+	deleted := 0
+	for e, ok := s.soonest(); ok && now.After(e.expires); e, ok = s.soonest() {
+		heap.Pop(&s.expiries)
+		delete(s.samples, e.id)
+		deleted++
+	}
+	return deleted
+}
+
+type Collector struct {
+	shards []*sampleShard
+	ch     chan *Sample
+	block  bool
+	count  atomic.Int64
+
+	skipUnchanged bool
+
+	maxSamples       int
+	maxSamplesPolicy string
+}
+
+func New(cfg config.ExporterConfig) *Collector {
+	c := &Collector{
+		ch:               make(chan *Sample, cfg.SampleBufferSize),
+		shards:           make([]*sampleShard, sampleStoreShards),
+		block:            cfg.SampleOverflowPolicy != config.OverflowPolicyDrop,
+		skipUnchanged:    cfg.SkipUnchangedSamples,
+		maxSamples:       cfg.MaxSamples,
+		maxSamplesPolicy: cfg.MaxSamplesPolicy,
+	}
+	for i := range c.shards {
+		c.shards[i] = &sampleShard{samples: map[string]*Sample{}}
+	}
+	go c.processSamples()
+	return c
+}
+
+// Count returns the number of stored samples, expired samples not purged yet
+// included.
+func (c *Collector) Count() int64 {
+	return c.count.Load()
+}
+
+// Buffered returns the number of samples waiting to be stored.
+func (c *Collector) Buffered() int {
+	return len(c.ch)
+}
+
+// shard returns the shard storing the sample with the given id (FNV-1a hash).
+func (c *Collector) shard(id string) *sampleShard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// Push queues a sample for storage. When the buffer is full, the sample is
+// dropped or the caller is blocked depending on the overflow policy.
+func (c *Collector) Push(sample *Sample) {
+	if c.block {
+		c.ch <- sample
+		return
+	}
+	select {
+	case c.ch <- sample:
+	default:
+		DroppedSamples.Inc()
+		log.Debugf("Sample buffer full, dropping %s", sample.Id)
+	}
+}
+
+// sameMetric reports whether two samples have the same name, help and labels.
+func sameMetric(a *Sample, b *Sample) bool {
+	if a.Name != b.Name || a.Help != b.Help || len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for k, v := range a.Labels {
+		if b.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// unchanged reports whether a sample has the same metric and value as the
+// stored one.
+func unchanged(previous *Sample, sample *Sample) bool {
+	return previous.Histogram == nil && sample.Histogram == nil && previous.Value == sample.Value && previous.Timestamp.Equal(sample.Timestamp) && previous.Type == sample.Type && sameMetric(previous, sample)
+}
+
+// store adds or replaces a sample. The descriptor of the replaced sample is
+// reused when the metric did not change, and only the expiry of the stored
+// sample is extended when the sample is unchanged and skipUnchanged is set.
+// Samples are only stored from the processSamples goroutine, or before samples
+// are pushed, so that the shard of the sample stays locked while samples of the
+// other shards are evicted.
+func (c *Collector) store(sample *Sample) {
+	shard := c.shard(sample.Id)
+	shard.mu.Lock()
+	previous, exists := shard.samples[sample.Id]
+	if exists && c.skipUnchanged && unchanged(previous, sample) {
+		if sample.Expires.After(previous.Expires) {
+			previous.Expires = sample.Expires
+			shard.track(previous)
+		}
+		shard.mu.Unlock()
+		return
+	}
+	if !exists && c.maxSamples > 0 && c.count.Load() >= int64(c.maxSamples) {
+		if c.maxSamplesPolicy == config.MaxSamplesPolicyReject {
+			shard.mu.Unlock()
+			RejectedSamples.Inc()
+			log.Debugf("Maximum number of samples reached, rejecting %s", sample.Id)
+			return
+		}
+		c.evict(shard, c.maxSamples/100+1)
+	}
+
+	if exists && sameMetric(previous, sample) {
+		sample.desc = previous.desc
+	} else {
+		sample.desc = prometheus.NewDesc(sample.Name, sample.Help, []string{}, sample.Labels)
+	}
+	if !exists {
+		c.count.Add(1)
+	}
+	shard.samples[sample.Id] = sample
+	shard.track(sample)
+	shard.mu.Unlock()
+}
+
+// purgeExpired deletes the samples expired at the given time and returns the
+// number of deleted samples.
+func (c *Collector) purgeExpired(now time.Time) int {
+	deleted := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		deleted += shard.purge(now)
+		shard.mu.Unlock()
+	}
+	c.count.Add(int64(-deleted))
+	return deleted
+}
+
+// evict makes room for n samples: expired samples are deleted first, then the
+// samples expiring the soonest. The locked shard is the one of the sample
+// being stored, which is locked by the caller.
+func (c *Collector) evict(locked *sampleShard, n int) {
+	lock := func(shard *sampleShard) {
+		if shard != locked {
+			shard.mu.Lock()
+		}
+	}
+	unlock := func(shard *sampleShard) {
+		if shard != locked {
+			shard.mu.Unlock()
+		}
+	}
+
+	// The soonest expiry of every shard, the expired samples being deleted
+	now := time.Now()
+	deleted := 0
+	soonest := make([]expiry, len(c.shards))
+	found := make([]bool, len(c.shards))
+	for i, shard := range c.shards {
+		lock(shard)
+		deleted += shard.purge(now)
+		soonest[i], found[i] = shard.soonest()
+		unlock(shard)
+	}
+	c.count.Add(int64(-deleted))
+	if n -= deleted; n <= 0 {
+		return
+	}
+
+	evicted := 0
+	for evicted < n {
+		next := -1
+		for i := range soonest {
+			if found[i] && (next < 0 || soonest[i].expires.Before(soonest[next].expires)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		// The sample may have been deleted since its shard was unlocked
+		shard := c.shards[next]
+		lock(shard)
+		if e, ok := shard.soonest(); ok && e.id == soonest[next].id && e.expires.Equal(soonest[next].expires) {
+			heap.Pop(&shard.expiries)
+			delete(shard.samples, e.id)
+			evicted++
+		}
+		soonest[next], found[next] = shard.soonest()
+		unlock(shard)
+	}
+	c.count.Add(int64(-evicted))
+	EvictedSamples.Add(float64(evicted))
+	log.Debugf("Maximum number of samples reached, evicted %d samples", evicted)
+}
+
+// hasLabels reports whether a sample has all the given labels.
+func hasLabels(sample *Sample, labels map[string]string) bool {
+	for k, v := range labels {
+		if sample.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Expire deletes the samples of a filter having all the given labels, e.g.
+// the samples of a device which went offline, and returns their number.
+func (c *Collector) Expire(filter string, labels map[string]string) int {
+	deleted := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for k, sample := range shard.samples {
+			if sample.Filter == filter && hasLabels(sample, labels) {
+				delete(shard.samples, k)
+				deleted++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	c.count.Add(int64(-deleted))
+	return deleted
+}
+
+// Zero sets to zero the gauges of a filter having all the given labels and
+// returns their number. They still expire after the purge delay.
+func (c *Collector) Zero(filter string, labels map[string]string) int {
+	zeroed := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for k, sample := range shard.samples {
+			if sample.Filter == filter && sample.Type == prometheus.GaugeValue && sample.Histogram == nil && hasLabels(sample, labels) {
+				// The stored samples are shared with the scrapes, replace them
+				zero := *sample
+				zero.Value = 0
+				shard.samples[k] = &zero
+				zeroed++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return zeroed
+}
+
+// ForEach calls fn for every stored sample, one shard at a time. The samples
+// must not be modified.
+func (c *Collector) ForEach(fn func(sample *Sample)) {
+	for _, shard := range c.shards {
+		shard.mu.RLock()
+		for _, sample := range shard.samples {
+			fn(sample)
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+func (c *Collector) processSamples() {
+	ticker := time.NewTicker(time.Minute).C
+	for {
+		select {
+		case sample := <-c.ch:
+			c.store(sample)
+		case <-ticker:
+			// Garbage collect expired samples.
+			c.purgeExpired(time.Now())
+		}
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ch <- DroppedSamples
+	ch <- EvictedSamples
+	ch <- RejectedSamples
+
+	c.collect(ch, "", nil)
+}
+
+// collect sends the samples of a tenant which are not expired, and whose
+// filter is accepted by keep when not nil.
+func (c *Collector) collect(ch chan<- prometheus.Metric, tenant string, keep func(sample *Sample) bool) {
+	now := time.Now()
+	c.ForEach(func(sample *Sample) {
+		if now.After(sample.Expires) || sample.Tenant != tenant {
+			return
+		}
+		if keep != nil && !keep(sample) {
+			return
+		}
+		metric, err := sample.Metric(sample.desc)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(sample.desc, err)
+			return
+		}
+		ch <- metric
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- DroppedSamples.Desc()
+	ch <- EvictedSamples.Desc()
+	ch <- RejectedSamples.Desc()
+}
+
+type tenantCollector struct {
+	c      *Collector
+	tenant string
+}
+
+// Tenant returns a collector exposing the samples of a tenant having its own
+// metrics path, which are not exposed by the collector itself.
+func (c *Collector) Tenant(tenant string) prometheus.Collector {
+	return &tenantCollector{c: c, tenant: tenant}
+}
+
+// Collect implements prometheus.Collector.
+func (t *tenantCollector) Collect(ch chan<- prometheus.Metric) {
+	t.c.collect(ch, t.tenant, nil)
+}
+
+// Describe implements prometheus.Collector. The collector is unchecked as the
+// samples are not known in advance.
+func (t *tenantCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+type filteredCollector struct {
+	c        *Collector
+	keep     func(sample *Sample) bool
+	counters bool
+}
+
+// Filtered returns a collector exposing the samples accepted by keep, and the
+// counters of the collector when counters is set.
+func (c *Collector) Filtered(keep func(sample *Sample) bool, counters bool) prometheus.Collector {
+	return &filteredCollector{c: c, keep: keep, counters: counters}
+}
+
+// Collect implements prometheus.Collector.
+func (f *filteredCollector) Collect(ch chan<- prometheus.Metric) {
+	if f.counters {
+		ch <- DroppedSamples
+		ch <- EvictedSamples
+		ch <- RejectedSamples
+	}
+	f.c.collect(ch, "", f.keep)
+}
+
+// Describe implements prometheus.Collector. The collector is unchecked as the
+// samples are not known in advance.
+func (f *filteredCollector) Describe(ch chan<- *prometheus.Desc) {}
@@ -0,0 +1,140 @@
+package collector
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// stored returns the number of samples actually stored.
+func stored(c *Collector) int64 {
+	var n int64
+	c.ForEach(func(*Sample) { n++ })
+	return n
+}
+
+// The count of samples does not drift when samples are stored while others
+// are expired or evicted.
+func TestStoreCount(t *testing.T) {
+	for _, policy := range []string{config.MaxSamplesPolicyEvict, config.MaxSamplesPolicyReject} {
+		c := New(config.ExporterConfig{SampleBufferSize: 100, MaxSamples: 50, MaxSamplesPolicy: policy})
+		var wg sync.WaitGroup
+		for worker := 0; worker < 4; worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					device := fmt.Sprintf("device%d", i%100)
+					if i%7 == worker {
+						c.Expire("zigbee", map[string]string{"device": device})
+						continue
+					}
+					c.Push(&Sample{
+						Id:      device,
+						Name:    "temperature",
+						Labels:  map[string]string{"device": device},
+						Value:   float64(i),
+						Type:    prometheus.GaugeValue,
+						Expires: time.Now().Add(time.Duration(i) * time.Second),
+						Filter:  "zigbee",
+					})
+				}
+			}()
+		}
+		wg.Wait()
+		// The last samples may still be being stored
+		deadline := time.Now().Add(time.Second)
+		for c.Buffered() > 0 || c.Count() != stored(c) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: count = %d, %d samples stored", policy, c.Count(), stored(c))
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if count := c.Count(); count > 50 {
+			t.Errorf("%s: %d samples stored, maximum 50", policy, count)
+		}
+	}
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+// The samples expiring the soonest are evicted first, and the rejected samples
+// are not counted as evicted.
+func TestMaxSamples(t *testing.T) {
+	sample := func(id string, expires time.Duration) *Sample {
+		return &Sample{Id: id, Name: "temperature", Labels: map[string]string{"device": id}, Type: prometheus.GaugeValue, Expires: time.Now().Add(expires)}
+	}
+	for _, policy := range []string{config.MaxSamplesPolicyEvict, config.MaxSamplesPolicyReject} {
+		c := New(config.ExporterConfig{MaxSamples: 3, MaxSamplesPolicy: policy})
+		c.store(sample("a", 3*time.Hour))
+		c.store(sample("b", time.Hour))
+		c.store(sample("c", 2*time.Hour))
+		evicted, rejected := counterValue(EvictedSamples), counterValue(RejectedSamples)
+		c.store(sample("d", 4*time.Hour))
+		// An existing sample is replaced whatever the policy
+		c.store(sample("c", 5*time.Hour))
+
+		ids := map[string]bool{}
+		c.ForEach(func(sample *Sample) { ids[sample.Id] = true })
+		want := map[string]bool{"a": true, "c": true, "d": true}
+		wantEvicted, wantRejected := 1.0, 0.0
+		if policy == config.MaxSamplesPolicyReject {
+			want = map[string]bool{"a": true, "b": true, "c": true}
+			wantEvicted, wantRejected = 0, 1
+		}
+		if !maps.Equal(ids, want) {
+			t.Errorf("%s: stored %v, want %v", policy, ids, want)
+		}
+		if got := counterValue(EvictedSamples) - evicted; got != wantEvicted {
+			t.Errorf("%s: %v samples evicted, want %v", policy, got, wantEvicted)
+		}
+		if got := counterValue(RejectedSamples) - rejected; got != wantRejected {
+			t.Errorf("%s: %v samples rejected, want %v", policy, got, wantRejected)
+		}
+		if count := c.Count(); count != 3 {
+			t.Errorf("%s: count = %d, want 3", policy, count)
+		}
+	}
+}
+
+// A sample identical to the stored one is still stored when a different value
+// is queued before it.
+func TestSkipUnchanged(t *testing.T) {
+	// The samples are stored by the test instead of processSamples
+	c := &Collector{ch: make(chan *Sample, 10), shards: make([]*sampleShard, sampleStoreShards), skipUnchanged: true}
+	for i := range c.shards {
+		c.shards[i] = &sampleShard{samples: map[string]*Sample{}}
+	}
+	sample := func(value float64, expires time.Time) *Sample {
+		return &Sample{Id: "plug", Name: "power", Labels: map[string]string{}, Value: value, Type: prometheus.GaugeValue, Expires: expires}
+	}
+	now := time.Now()
+	c.store(sample(1, now.Add(time.Minute)))
+	previous := c.shard("plug").samples["plug"]
+	c.Push(sample(1, now.Add(2*time.Minute)))
+	c.Push(sample(2, now.Add(3*time.Minute)))
+	c.Push(sample(1, now.Add(4*time.Minute)))
+	c.store(<-c.ch)
+	if stored := c.shard("plug").samples["plug"]; stored != previous || !stored.Expires.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("unchanged sample stored again or expiring at %v, want %v", stored.Expires, now.Add(2*time.Minute))
+	}
+	c.store(<-c.ch)
+	if stored := c.shard("plug").samples["plug"]; stored.Value != 2 {
+		t.Errorf("value = %v, want 2", stored.Value)
+	}
+	c.store(<-c.ch)
+	if stored := c.shard("plug").samples["plug"]; stored.Value != 1 || !stored.Expires.Equal(now.Add(4*time.Minute)) {
+		t.Errorf("value = %v expiring at %v, want 1 expiring at %v", stored.Value, stored.Expires, now.Add(4*time.Minute))
+	}
+}
@@ -0,0 +1,73 @@
+package collector
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Histogram is the distribution of a histogram sample. Counts are the
+// cumulative counts of the buckets whose upper bounds are Bounds, the +Inf
+// bucket being Count.
+type Histogram struct {
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+}
+
+// Metric returns the Prometheus metric of a sample.
+func (s *Sample) Metric(desc *prometheus.Desc) (prometheus.Metric, error) {
+	var metric prometheus.Metric
+	var err error
+	if s.Histogram != nil {
+		buckets := make(map[float64]uint64, len(s.Histogram.Bounds))
+		for i, bound := range s.Histogram.Bounds {
+			buckets[bound] = s.Histogram.Counts[i]
+		}
+		metric, err = prometheus.NewConstHistogram(desc, s.Histogram.Count, s.Histogram.Sum, buckets)
+	} else {
+		metric, err = prometheus.NewConstMetric(desc, s.Type, s.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.Timestamp.IsZero() {
+		metric = prometheus.NewMetricWithTimestamp(s.Timestamp, metric)
+	}
+	return metric, nil
+}
+
+// Components returns the sample itself, or the _bucket, _sum and _count
+// counters of a histogram sample, for the outputs without histograms.
+func (s *Sample) Components() []*Sample {
+	if s.Histogram == nil {
+		return []*Sample{s}
+	}
+	component := func(suffix string, le string, value float64) *Sample {
+		c := *s
+		c.Histogram = nil
+		c.Id = s.Id + "\x00" + suffix + le
+		c.Name = s.Name + suffix
+		c.Type = prometheus.CounterValue
+		c.Value = value
+		c.desc = nil
+		if le != "" {
+			c.Labels = make(map[string]string, len(s.Labels)+1)
+			for k, v := range s.Labels {
+				c.Labels[k] = v
+			}
+			c.Labels["le"] = le
+		}
+		return &c
+	}
+	components := make([]*Sample, 0, len(s.Histogram.Bounds)+3)
+	for i, bound := range s.Histogram.Bounds {
+		components = append(components, component("_bucket", strconv.FormatFloat(bound, 'g', -1, 64), float64(s.Histogram.Counts[i])))
+	}
+	components = append(components,
+		component("_bucket", "+Inf", float64(s.Histogram.Count)),
+		component("_sum", "", s.Histogram.Sum),
+		component("_count", "", float64(s.Histogram.Count)))
+	return components
+}
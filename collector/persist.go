@@ -0,0 +1,190 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Version of the snapshot file format
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int              `json:"version"`
+	Saved   time.Time        `json:"saved"`
+	Samples []snapshotSample `json:"samples"`
+}
+
+type snapshotSample struct {
+	Id        string               `json:"id"`
+	Name      string               `json:"name"`
+	Labels    map[string]string    `json:"labels"`
+	Help      string               `json:"help"`
+	Value     snapshotFloat        `json:"value"`
+	Type      prometheus.ValueType `json:"type"`
+	Expires   time.Time            `json:"expires"`
+	Timestamp time.Time            `json:"timestamp"`
+	Topic     string               `json:"topic,omitempty"`
+	Tenant    string               `json:"tenant,omitempty"`
+	Filter    string               `json:"filter,omitempty"`
+	Group     string               `json:"group,omitempty"`
+	Histogram *snapshotHistogram   `json:"histogram,omitempty"`
+}
+
+type snapshotHistogram struct {
+	Count  uint64          `json:"count"`
+	Sum    snapshotFloat   `json:"sum"`
+	Bounds []snapshotFloat `json:"bounds"`
+	Counts []uint64        `json:"counts"`
+}
+
+// snapshotFloat is a value of a snapshot, NaN and the infinities being
+// encoded as the "NaN", "+Inf" and "-Inf" strings which JSON has no number
+// for.
+type snapshotFloat float64
+
+// MarshalJSON implements json.Marshaler.
+func (f snapshotFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return json.Marshal(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *snapshotFloat) UnmarshalJSON(data []byte) error {
+	var v float64
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		var err error
+		if v, err = strconv.ParseFloat(s, 64); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*f = snapshotFloat(v)
+	return nil
+}
+
+func newSnapshotHistogram(h *Histogram) *snapshotHistogram {
+	if h == nil {
+		return nil
+	}
+	bounds := make([]snapshotFloat, len(h.Bounds))
+	for i, bound := range h.Bounds {
+		bounds[i] = snapshotFloat(bound)
+	}
+	return &snapshotHistogram{Count: h.Count, Sum: snapshotFloat(h.Sum), Bounds: bounds, Counts: h.Counts}
+}
+
+func (h *snapshotHistogram) histogram() *Histogram {
+	if h == nil {
+		return nil
+	}
+	bounds := make([]float64, len(h.Bounds))
+	for i, bound := range h.Bounds {
+		bounds[i] = float64(bound)
+	}
+	return &Histogram{Count: h.Count, Sum: float64(h.Sum), Bounds: bounds, Counts: h.Counts}
+}
+
+// Save writes the samples not expired yet to a snapshot file. The file is
+// replaced atomically.
+func (c *Collector) Save(path string) (int, error) {
+	now := time.Now()
+	s := snapshot{Version: snapshotVersion, Saved: now, Samples: make([]snapshotSample, 0, c.Count())}
+	c.ForEach(func(sample *Sample) {
+		if now.After(sample.Expires) {
+			return
+		}
+		s.Samples = append(s.Samples, snapshotSample{
+			Id:        sample.Id,
+			Name:      sample.Name,
+			Labels:    sample.Labels,
+			Help:      sample.Help,
+			Value:     snapshotFloat(sample.Value),
+			Type:      sample.Type,
+			Expires:   sample.Expires,
+			Timestamp: sample.Timestamp,
+			Topic:     sample.Topic,
+			Tenant:    sample.Tenant,
+			Filter:    sample.Filter,
+			Group:     sample.Group,
+			Histogram: newSnapshotHistogram(sample.Histogram),
+		})
+	})
+
+	content, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(s.Samples), os.Rename(tmp.Name(), path)
+}
+
+// Restore stores the samples of a snapshot file which are not expired yet and
+// returns their number. It must be called before samples are pushed. A
+// missing file is not an error.
+func (c *Collector) Restore(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(content, &s); err != nil {
+		return 0, err
+	}
+	if s.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	now := time.Now()
+	restored := 0
+	for _, v := range s.Samples {
+		if now.After(v.Expires) {
+			continue
+		}
+		c.store(&Sample{
+			Id:        v.Id,
+			Name:      v.Name,
+			Labels:    v.Labels,
+			Help:      v.Help,
+			Value:     float64(v.Value),
+			Type:      v.Type,
+			Expires:   v.Expires,
+			Timestamp: v.Timestamp,
+			Topic:     v.Topic,
+			Tenant:    v.Tenant,
+			Filter:    v.Filter,
+			Group:     v.Group,
+			Histogram: v.Histogram.histogram(),
+		})
+		restored++
+	}
+	return restored, nil
+}
@@ -0,0 +1,66 @@
+package collector
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+func sameFloat(a float64, b float64) bool {
+	return a == b || math.IsNaN(a) && math.IsNaN(b)
+}
+
+// The non finite values survive a save and a restore.
+func TestSaveRestore(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	samples := []*Sample{
+		{Id: "finite", Name: "finite", Value: 21.5},
+		{Id: "nan", Name: "nan", Value: math.NaN()},
+		{Id: "inf", Name: "inf", Value: math.Inf(1)},
+		{Id: "-inf", Name: "minus_inf", Value: math.Inf(-1)},
+		{Id: "histogram", Name: "histogram", Histogram: &Histogram{Count: 3, Sum: math.NaN(), Bounds: []float64{math.Inf(-1), 1}, Counts: []uint64{1, 2}}},
+	}
+	c := New(config.ExporterConfig{})
+	for _, sample := range samples {
+		sample.Labels = map[string]string{"device": "kitchen"}
+		sample.Type = prometheus.GaugeValue
+		sample.Expires = expires
+		c.store(sample)
+	}
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if saved, err := c.Save(path); err != nil || saved != len(samples) {
+		t.Fatalf("Save = %d, %v, want %d", saved, err, len(samples))
+	}
+	restored := New(config.ExporterConfig{})
+	if n, err := restored.Restore(path); err != nil || n != len(samples) {
+		t.Fatalf("Restore = %d, %v, want %d", n, err, len(samples))
+	}
+
+	got := map[string]*Sample{}
+	restored.ForEach(func(sample *Sample) {
+		got[sample.Id] = sample
+	})
+	for _, want := range samples {
+		sample, ok := got[want.Id]
+		if !ok {
+			t.Errorf("sample %s not restored", want.Id)
+			continue
+		}
+		if !sameFloat(sample.Value, want.Value) {
+			t.Errorf("sample %s: value = %v, want %v", want.Id, sample.Value, want.Value)
+		}
+		if want.Histogram == nil {
+			continue
+		}
+		h := sample.Histogram
+		if h == nil || h.Count != want.Histogram.Count || !sameFloat(h.Sum, want.Histogram.Sum) || len(h.Bounds) != 2 || h.Bounds[0] != math.Inf(-1) || h.Counts[1] != 2 {
+			t.Errorf("sample %s: histogram = %+v, want %+v", want.Id, h, want.Histogram)
+		}
+	}
+}
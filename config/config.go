@@ -0,0 +1,507 @@
+// Package config defines the configuration of the exporter (mqtt_exporter.json)
+// and of the filters (configuration.json).
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/go-defaults"
+	"github.com/spf13/viper"
+)
+
+const (
+	PayloadTypeJson     = "json"
+	PayloadTypeRaw      = "raw"
+	PayloadTypeCollectd = "collectd"
+
+	OverflowPolicyBlock = "block"
+	OverflowPolicyDrop  = "drop"
+
+	MaxSamplesPolicyEvict  = "evict"
+	MaxSamplesPolicyReject = "reject"
+
+	RateLimitModeDiscard = "discard"
+	RateLimitModeAverage = "average"
+
+	NonNumericSentinel = "sentinel"
+	NonNumericSkip     = "skip"
+	NonNumericInfo     = "info"
+	NonNumericEnum     = "enum"
+
+	RelabelActionReplace   = "replace"
+	RelabelActionKeep      = "keep"
+	RelabelActionDrop      = "drop"
+	RelabelActionLabelMap  = "labelmap"
+	RelabelActionLabelDrop = "labeldrop"
+	RelabelActionLabelKeep = "labelkeep"
+
+	BoundsPolicyDrop  = "drop"
+	BoundsPolicyClamp = "clamp"
+	BoundsPolicyKeep  = "keep"
+
+	OnErrorIgnore = "ignore"
+	OnErrorLog    = "log"
+	OnErrorCount  = "count"
+	OnErrorDrop   = "drop"
+
+	ClockSkewPolicyDrop    = "drop"
+	ClockSkewPolicyReceive = "receive"
+	ClockSkewPolicyKeep    = "keep"
+
+	AvailabilityActionExpire = "expire"
+	AvailabilityActionZero   = "zero"
+)
+
+var (
+	payloadTypesMu     sync.RWMutex
+	customPayloadTypes = map[string]bool{}
+)
+
+// RegisterPayloadType declares a payloadType handled by a registered decoder,
+// so that the filters using it are valid.
+func RegisterPayloadType(payloadType string) {
+	payloadTypesMu.Lock()
+	defer payloadTypesMu.Unlock()
+	customPayloadTypes[payloadType] = true
+}
+
+// IsCustomPayloadType reports whether a payloadType was registered with
+// RegisterPayloadType.
+func IsCustomPayloadType(payloadType string) bool {
+	payloadTypesMu.RLock()
+	defer payloadTypesMu.RUnlock()
+	return customPayloadTypes[payloadType]
+}
+
+type ExporterConfig struct {
+	ListeningAddress  string `mapstructure:"listeningAddress" default:":9393"`
+	MetricsPath       string `mapstructure:"metricsPath" default:"/metrics"`
+	GoMetricsPath     string `mapstructure:"gometricsPath" default:"/gometrics"`
+	ConfigurationFile string `mapstructure:"configurationFile"`
+
+	SampleBufferSize     int    `mapstructure:"sampleBufferSize" default:"1000"`
+	SampleOverflowPolicy string `mapstructure:"sampleOverflowPolicy" default:"block"`
+	MaxSamples           int    `mapstructure:"maxSamples" default:"0"`
+	MaxSamplesPolicy     string `mapstructure:"maxSamplesPolicy" default:"evict"`
+	SkipUnchangedSamples bool   `mapstructure:"skipUnchangedSamples" default:"false"`
+
+	StateFile         string        `mapstructure:"stateFile"`
+	StateSaveInterval time.Duration `mapstructure:"stateSaveInterval" default:"5m"`
+
+	ConfigurationAuthorization   string        `mapstructure:"configurationAuthorization"`
+	ConfigurationRefreshInterval time.Duration `mapstructure:"configurationRefreshInterval" default:"0s"`
+
+	LogLevelEndpoint bool `mapstructure:"logLevelEndpoint" default:"false"`
+
+	ProbeEndpoint   bool          `mapstructure:"probeEndpoint" default:"false"`
+	ProbeMaxTimeout time.Duration `mapstructure:"probeMaxTimeout" default:"30s"`
+}
+
+type ExporterMqttConfig struct {
+	Broker   string `mapstructure:"broker" default:"tcp://127.0.0.1:1883"`
+	ClientId string `mapstructure:"clientId" default:"mqtt_exporter_client"`
+	Qos      byte   `mapstructure:"qos" default:"0"`
+
+	Username                 string        `mapstructure:"username"`
+	Password                 string        `mapstructure:"password"`
+	PasswordFile             string        `mapstructure:"passwordFile"`
+	CaFile                   string        `mapstructure:"caFile"`
+	CertFile                 string        `mapstructure:"certFile"`
+	KeyFile                  string        `mapstructure:"keyFile"`
+	InsecureSkipVerify       bool          `mapstructure:"insecureSkipVerify"`
+	CredentialsCheckInterval time.Duration `mapstructure:"credentialsCheckInterval" default:"30s"`
+
+	StatusTopic    string        `mapstructure:"statusTopic"`
+	StatusInterval time.Duration `mapstructure:"statusInterval" default:"60s"`
+	StatusRetain   bool          `mapstructure:"statusRetain" default:"true"`
+}
+
+type ExporterRemoteWriteConfig struct {
+	Url            string            `mapstructure:"url"`
+	Interval       time.Duration     `mapstructure:"interval" default:"15s"`
+	Timeout        time.Duration     `mapstructure:"timeout" default:"10s"`
+	Username       string            `mapstructure:"username"`
+	Password       string            `mapstructure:"password"`
+	BearerToken    string            `mapstructure:"bearerToken"`
+	Headers        map[string]string `mapstructure:"headers"`
+	ExternalLabels map[string]string `mapstructure:"externalLabels"`
+	MaxRetries     int               `mapstructure:"maxRetries" default:"5"`
+	MinBackoff     time.Duration     `mapstructure:"minBackoff" default:"500ms"`
+	MaxBackoff     time.Duration     `mapstructure:"maxBackoff" default:"30s"`
+}
+
+type ExporterPushgatewayConfig struct {
+	Url      string            `mapstructure:"url"`
+	Job      string            `mapstructure:"job" default:"mqtt_exporter"`
+	Interval time.Duration     `mapstructure:"interval" default:"15s"`
+	Grouping map[string]string `mapstructure:"grouping"`
+	Username string            `mapstructure:"username"`
+	Password string            `mapstructure:"password"`
+}
+
+type ExporterInfluxDBConfig struct {
+	Url           string        `mapstructure:"url"`
+	Org           string        `mapstructure:"org"`
+	Bucket        string        `mapstructure:"bucket"`
+	Token         string        `mapstructure:"token"`
+	BatchSize     int           `mapstructure:"batchSize" default:"1000"`
+	FlushInterval time.Duration `mapstructure:"flushInterval" default:"5s"`
+	Timeout       time.Duration `mapstructure:"timeout" default:"10s"`
+	MaxRetries    int           `mapstructure:"maxRetries" default:"3"`
+}
+
+type ExporterGraphiteConfig struct {
+	Address       string        `mapstructure:"address"`
+	Prefix        string        `mapstructure:"prefix"`
+	BatchSize     int           `mapstructure:"batchSize" default:"1000"`
+	FlushInterval time.Duration `mapstructure:"flushInterval" default:"5s"`
+	Timeout       time.Duration `mapstructure:"timeout" default:"10s"`
+}
+
+type ExporterOtlpConfig struct {
+	Endpoint      string            `mapstructure:"endpoint"`
+	Protocol      string            `mapstructure:"protocol" default:"grpc"`
+	Insecure      bool              `mapstructure:"insecure" default:"false"`
+	Headers       map[string]string `mapstructure:"headers"`
+	ServiceName   string            `mapstructure:"serviceName" default:"mqtt_exporter"`
+	BatchSize     int               `mapstructure:"batchSize" default:"1000"`
+	FlushInterval time.Duration     `mapstructure:"flushInterval" default:"5s"`
+	Timeout       time.Duration     `mapstructure:"timeout" default:"10s"`
+}
+
+type ExporterStatsDConfig struct {
+	Address       string        `mapstructure:"address"`
+	Prefix        string        `mapstructure:"prefix"`
+	TagFormat     string        `mapstructure:"tagFormat" default:"dogstatsd"`
+	MaxPacketSize int           `mapstructure:"maxPacketSize" default:"1432"`
+	BatchSize     int           `mapstructure:"batchSize" default:"100"`
+	FlushInterval time.Duration `mapstructure:"flushInterval" default:"1s"`
+}
+
+type ExporterBridgeConfig struct {
+	TopicPrefix   string        `mapstructure:"topicPrefix"`
+	TopicLabels   []string      `mapstructure:"topicLabels"`
+	Qos           byte          `mapstructure:"qos"`
+	Retain        bool          `mapstructure:"retain" default:"false"`
+	BatchSize     int           `mapstructure:"batchSize" default:"1000"`
+	FlushInterval time.Duration `mapstructure:"flushInterval" default:"1s"`
+	Timeout       time.Duration `mapstructure:"timeout" default:"10s"`
+}
+
+// ExporterDecoderConfig defines an external decoder of a payloadType, either a
+// command speaking the exec protocol or a Go plugin.
+type ExporterDecoderConfig struct {
+	PayloadType string        `mapstructure:"payloadType"`
+	Command     []string      `mapstructure:"command"`
+	Plugin      string        `mapstructure:"plugin"`
+	Timeout     time.Duration `mapstructure:"timeout"`
+}
+
+type ExporterConfiguration struct {
+	Config      ExporterConfig            `mapstructure:"config"`
+	Mqtt        ExporterMqttConfig        `mapstructure:"mqtt"`
+	RemoteWrite ExporterRemoteWriteConfig `mapstructure:"remoteWrite"`
+	Pushgateway ExporterPushgatewayConfig `mapstructure:"pushgateway"`
+	InfluxDB    ExporterInfluxDBConfig    `mapstructure:"influxdb"`
+	Graphite    ExporterGraphiteConfig    `mapstructure:"graphite"`
+	Otlp        ExporterOtlpConfig        `mapstructure:"otlp"`
+	StatsD      ExporterStatsDConfig      `mapstructure:"statsd"`
+	Bridge      ExporterBridgeConfig      `mapstructure:"bridge"`
+	Decoders    []ExporterDecoderConfig   `mapstructure:"decoders"`
+}
+
+type Entity struct {
+	Name        string `json:"group"`
+	LastUpdated string `json:"last_updated"`
+}
+
+type Sensor struct {
+	Filter                      string                 `json:"filter"`
+	Labels                      []string               `json:"labels"`
+	Values                      map[string]string      `json:"values"`
+	Group                       string                 `json:"group"`
+	Name                        string                 `json:"name"`
+	Disabled                    bool                   `json:"disabled"`
+	PayloadType                 string                 `json:"payloadType"`
+	Order                       int                    `json:"order" default:"0"`
+	LabelsCleanupFirstCharacter bool                   `json:"labelsCleanupFirstCharacter" default:"false"`
+	RateLimitInterval           float64                `json:"rateLimitInterval"`
+	RateLimitMode               string                 `json:"rateLimitMode"`
+	NonNumeric                  string                 `json:"nonNumeric"`
+	NonNumericSentinel          *float64               `json:"nonNumericSentinel"`
+	Enum                        map[string]float64     `json:"enum"`
+	Bounds                      map[string]ValueBounds `json:"bounds"`
+	TopicLabel                  string                 `json:"topicLabel"`
+	OnError                     string                 `json:"onError"`
+	Timestamp                   string                 `json:"timestamp"`
+	TimestampFormat             string                 `json:"timestampFormat"`
+	DeviceLabel                 string                 `json:"deviceLabel"`
+	RequestTopic                string                 `json:"requestTopic"`
+	RequestPayload              string                 `json:"requestPayload"`
+	ResponseTopic               string                 `json:"responseTopic"`
+	RequestTimeout              float64                `json:"requestTimeout"`
+	ExcludeTopics               []string               `json:"excludeTopics"`
+	Subscriptions               []string               `json:"subscriptions"`
+	Enabled                     *bool                  `json:"enabled"`
+	ActiveWindows               []TimeWindow           `json:"activeWindows"`
+	AvailabilityFilter          string                 `json:"availabilityFilter"`
+	AvailabilityOffline         []string               `json:"availabilityOffline"`
+	AvailabilityAction          string                 `json:"availabilityAction"`
+	InfoLabels                  map[string]string      `json:"infoLabels"`
+	Histograms                  map[string]Histogram   `json:"histograms"`
+	MaxClockSkew                float64                `json:"maxClockSkew"`
+	ClockSkewPolicy             string                 `json:"clockSkewPolicy"`
+	BatchPath                   string                 `json:"batchPath"`
+	BatchRemoteWrite            bool                   `json:"batchRemoteWrite"`
+}
+
+// Histogram defines a histogram decoded from the bucket counts of a JSON
+// payload. The upper bounds of the buckets are either defined by Buckets or
+// found in the payload.
+type Histogram struct {
+	Buckets     []float64 `json:"buckets"`
+	BucketsPath string    `json:"bucketsPath"`
+	Counts      string    `json:"counts"`
+	Sum         string    `json:"sum"`
+	Count       string    `json:"count"`
+	Cumulative  bool      `json:"cumulative"`
+}
+
+// TimeWindow is a period during which a filter is active, in the local time
+// of the exporter. Empty fields do not restrict the period.
+type TimeWindow struct {
+	Months []string `json:"months"`
+	Days   []string `json:"days"`
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+}
+
+// ValueBounds defines the valid range of a value and what to do with values
+// out of range, NaN or infinite.
+type ValueBounds struct {
+	Min    *float64 `json:"min"`
+	Max    *float64 `json:"max"`
+	Policy string   `json:"policy"`
+}
+
+// Tenant namespaces the metrics of the topics starting with TopicPrefix, so
+// that an exporter can serve a broker shared by several customers.
+type Tenant struct {
+	TopicPrefix         string            `json:"topicPrefix"`
+	Prefix              string            `json:"prefix"`
+	Labels              map[string]string `json:"labels"`
+	SeparateMetricsPath bool              `json:"separateMetricsPath"`
+}
+
+// RelabelConfig is a relabeling rule applied to the samples, as the
+// metric_relabel_configs of Prometheus. The metric name is the __name__ label.
+type RelabelConfig struct {
+	SourceLabels []string `json:"sourceLabels"`
+	Separator    *string  `json:"separator"`
+	Regex        *string  `json:"regex"`
+	TargetLabel  string   `json:"targetLabel"`
+	Replacement  *string  `json:"replacement"`
+	Action       string   `json:"action"`
+}
+
+// HomieConfig enables the decoding of the devices following the Homie
+// convention.
+type HomieConfig struct {
+	Enabled   bool   `json:"enabled"`
+	BaseTopic string `json:"baseTopic"`
+}
+
+type Configuration struct {
+	Sensors    map[string]Sensor `json:"sensors"`
+	Prefix     string            `json:"prefix"`
+	Labels     map[string]string `json:"labels"`
+	TopicLabel string            `json:"topicLabel"`
+	AutoTopics bool              `json:"autoTopics"`
+	Topics     []string          `mapstructure:"topics"`
+	PurgeDelay int64             `json:"purgeDelay"`
+	Tenants    map[string]Tenant `json:"tenants"`
+
+	MaxPayloadSize      int      `json:"maxPayloadSize"`
+	ExcludeTopics       []string `json:"excludeTopics"`
+	MessageFlagsMetrics bool     `json:"messageFlagsMetrics"`
+	DedupWindow         float64  `json:"dedupWindow"`
+
+	RelabelConfigs []RelabelConfig `json:"relabelConfigs"`
+
+	LastSeenLabels     []string `json:"lastSeenLabels"`
+	LastSeenPurgeDelay int64    `json:"lastSeenPurgeDelay"`
+
+	Homie HomieConfig `json:"homie"`
+}
+
+type TimeValueTypeFloat struct {
+	Time  int64   `json:"time"`
+	Value float64 `json:"value"`
+}
+
+type TimeValueTypeString struct {
+	Time  int64  `json:"time"`
+	Value string `json:"value"`
+}
+
+type TimeValueTypeStringArray struct {
+	Time  int64    `json:"time"`
+	Value []string `json:"value"`
+}
+
+type TimeValueTypeStringBool struct {
+	Time  int64 `json:"time"`
+	Value bool  `json:"value"`
+}
+
+// Load reads the exporter configuration with viper from the file name (without
+// extension) found in path, the defaults being applied first.
+func Load(path string, name string) (ExporterConfiguration, error) {
+	cfg := ExporterConfiguration{}
+	viper.AddConfigPath(path)
+	viper.SetConfigName(name)
+	viper.SetConfigType("json")
+	viper.AutomaticEnv()
+
+	if err := viper.ReadInConfig(); err != nil {
+		return cfg, err
+	}
+	defaults.SetDefaults(&cfg)
+	err := viper.Unmarshal(&cfg)
+	return cfg, err
+}
+
+// Validate checks the options of the exporter configuration.
+func (c ExporterConfig) Validate() error {
+	if c.SampleOverflowPolicy != OverflowPolicyBlock && c.SampleOverflowPolicy != OverflowPolicyDrop {
+		return fmt.Errorf("Wrong sampleOverflowPolicy value: %s", c.SampleOverflowPolicy)
+	}
+	if c.MaxSamplesPolicy != MaxSamplesPolicyEvict && c.MaxSamplesPolicy != MaxSamplesPolicyReject {
+		return fmt.Errorf("Wrong maxSamplesPolicy value: %s", c.MaxSamplesPolicy)
+	}
+	return nil
+}
+
+// ValidTopicFilter reports whether a topic filter is valid: not empty, with
+// wildcards (+ or #) only as whole levels and # only as the last level.
+func ValidTopicFilter(topic string) bool {
+	if topic == "" {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the options of a tenant and returns all its problems.
+func (t Tenant) Validate() []string {
+	var problems []string
+	if t.TopicPrefix == "" {
+		problems = append(problems, "no topicPrefix defined")
+	}
+	return problems
+}
+
+// IsEnabled reports whether the filter is neither disabled nor not enabled.
+func (v Sensor) IsEnabled() bool {
+	return !v.Disabled && (v.Enabled == nil || *v.Enabled)
+}
+
+// Validate checks the options of a filter and returns all its problems.
+func (v Sensor) Validate() []string {
+	var problems []string
+	if v.PayloadType != PayloadTypeJson && v.PayloadType != PayloadTypeRaw && v.PayloadType != PayloadTypeCollectd && !IsCustomPayloadType(v.PayloadType) {
+		problems = append(problems, fmt.Sprintf("wrong payloadType value %q", v.PayloadType))
+	}
+	if v.PayloadType == PayloadTypeJson && len(v.Values) == 0 && len(v.InfoLabels) == 0 && len(v.Histograms) == 0 {
+		problems = append(problems, "no values defined for the json payloadType")
+	}
+	if len(v.InfoLabels) > 0 && v.PayloadType != PayloadTypeJson {
+		problems = append(problems, "infoLabels is only supported by the json payloadType")
+	}
+	if len(v.Histograms) > 0 && v.PayloadType != PayloadTypeJson {
+		problems = append(problems, "histograms is only supported by the json payloadType")
+	}
+	for name, h := range v.Histograms {
+		if h.Counts == "" {
+			problems = append(problems, fmt.Sprintf("no counts defined for histogram %s", name))
+		}
+		if (len(h.Buckets) == 0) == (h.BucketsPath == "") {
+			problems = append(problems, fmt.Sprintf("either buckets or bucketsPath must be defined for histogram %s", name))
+		}
+		for i := 1; i < len(h.Buckets); i++ {
+			if h.Buckets[i] <= h.Buckets[i-1] {
+				problems = append(problems, fmt.Sprintf("buckets of histogram %s are not increasing", name))
+				break
+			}
+		}
+	}
+	if v.NonNumeric != "" && v.NonNumeric != NonNumericSentinel && v.NonNumeric != NonNumericSkip && v.NonNumeric != NonNumericInfo && v.NonNumeric != NonNumericEnum {
+		problems = append(problems, fmt.Sprintf("wrong nonNumeric value %q", v.NonNumeric))
+	}
+	for name, bounds := range v.Bounds {
+		if bounds.Policy != "" && bounds.Policy != BoundsPolicyDrop && bounds.Policy != BoundsPolicyClamp && bounds.Policy != BoundsPolicyKeep {
+			problems = append(problems, fmt.Sprintf("wrong bounds policy value %q for %s", bounds.Policy, name))
+		}
+		if bounds.Min != nil && bounds.Max != nil && *bounds.Min > *bounds.Max {
+			problems = append(problems, fmt.Sprintf("bounds min greater than max for %s", name))
+		}
+	}
+	if v.OnError != "" && v.OnError != OnErrorIgnore && v.OnError != OnErrorLog && v.OnError != OnErrorCount && v.OnError != OnErrorDrop {
+		problems = append(problems, fmt.Sprintf("wrong onError value %q", v.OnError))
+	}
+	if v.AvailabilityAction != "" && v.AvailabilityAction != AvailabilityActionExpire && v.AvailabilityAction != AvailabilityActionZero {
+		problems = append(problems, fmt.Sprintf("wrong availabilityAction value %q", v.AvailabilityAction))
+	}
+	if v.DeviceLabel != "" && v.PayloadType != PayloadTypeJson {
+		problems = append(problems, "deviceLabel is only supported by the json payloadType")
+	}
+	if v.Timestamp != "" && v.PayloadType != PayloadTypeJson {
+		problems = append(problems, "timestamp is only supported by the json payloadType")
+	}
+	if v.BatchPath != "" && v.PayloadType != PayloadTypeJson {
+		problems = append(problems, "batchPath is only supported by the json payloadType")
+	}
+	if v.BatchPath != "" && v.DeviceLabel != "" {
+		problems = append(problems, "batchPath cannot be combined with deviceLabel")
+	}
+	if v.BatchRemoteWrite && v.BatchPath == "" {
+		problems = append(problems, "batchRemoteWrite requires a batchPath")
+	}
+	if v.BatchRemoteWrite && v.Timestamp == "" {
+		problems = append(problems, "batchRemoteWrite requires a timestamp")
+	}
+	if v.MaxClockSkew > 0 && v.Timestamp == "" {
+		problems = append(problems, "maxClockSkew requires a timestamp")
+	}
+	if v.ClockSkewPolicy != "" && v.ClockSkewPolicy != ClockSkewPolicyDrop && v.ClockSkewPolicy != ClockSkewPolicyReceive && v.ClockSkewPolicy != ClockSkewPolicyKeep {
+		problems = append(problems, fmt.Sprintf("wrong clockSkewPolicy value %q", v.ClockSkewPolicy))
+	}
+	for _, topic := range v.ExcludeTopics {
+		if !ValidTopicFilter(topic) {
+			problems = append(problems, fmt.Sprintf("invalid excludeTopics pattern %q", topic))
+		}
+	}
+	for _, topic := range v.Subscriptions {
+		if !ValidTopicFilter(topic) {
+			problems = append(problems, fmt.Sprintf("invalid subscriptions topic %q", topic))
+		}
+	}
+	if v.RequestTopic != "" && v.ResponseTopic == "" {
+		problems = append(problems, "no responseTopic defined for the requestTopic")
+	}
+	if v.RateLimitMode != "" && v.RateLimitMode != RateLimitModeDiscard && v.RateLimitMode != RateLimitModeAverage {
+		problems = append(problems, fmt.Sprintf("wrong rateLimitMode value %q", v.RateLimitMode))
+	}
+	return problems
+}
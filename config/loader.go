@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Loader reads the filter configuration from a local file or an HTTP(S) URL.
+type Loader struct {
+	Location      string
+	Authorization string
+
+	client *http.Client
+
+	// Last ETag returned by the remote configuration server and last content
+	// loaded, used to detect unchanged configurations on refresh.
+	etag    string
+	content []byte
+}
+
+// NewLoader returns a loader of the configuration at location, a file path or
+// an HTTP(S) URL. The authorization, when not empty, is sent as the
+// Authorization header of the HTTP requests.
+func NewLoader(location string, authorization string) *Loader {
+	return &Loader{
+		Location:      location,
+		Authorization: authorization,
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (l *Loader) isRemote() bool {
+	return strings.HasPrefix(l.Location, "http://") || strings.HasPrefix(l.Location, "https://")
+}
+
+// read returns the content of the configuration file, either from the local
+// filesystem or from an HTTP(S) URL. A nil content with no error means the
+// remote server reported the configuration as not modified.
+func (l *Loader) read() ([]byte, error) {
+	if !l.isRemote() {
+		return os.ReadFile(l.Location)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, l.Location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.Authorization != "" {
+		req.Header.Set("Authorization", l.Authorization)
+	}
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	l.etag = resp.Header.Get("ETag")
+	return content, nil
+}
+
+// Load reads and parses the configuration. It returns a nil configuration with
+// no error when the configuration did not change since the last successful
+// load.
+func (l *Loader) Load() (*Configuration, error) {
+	content, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	if content == nil || (l.content != nil && bytes.Equal(content, l.content)) {
+		return nil, nil
+	}
+
+	newConfiguration := &Configuration{}
+	if err := json.Unmarshal(content, newConfiguration); err != nil {
+		return nil, err
+	}
+	l.content = content
+	return newConfiguration, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// refreshConfiguration periodically reloads the configuration and applies it
+// when it changed. Errors are logged and the current configuration is kept.
+func refreshConfiguration(interval time.Duration) {
+	log.Infof("Refreshing configuration every %s", interval)
+	for range time.Tick(interval) {
+		newConfiguration, err := configurationLoader.Load()
+		if err != nil {
+			log.Errorf("Failed to refresh configuration %s: %v", exporterConfig.Config.ConfigurationFile, err)
+			continue
+		}
+		if newConfiguration == nil {
+			log.Debug("Configuration unchanged")
+			continue
+		}
+		log.Infof("Configuration changed: %d entries", len(newConfiguration.Sensors))
+		if err := messageDecoder.Apply(newConfiguration, *skipInvalidFilters); err != nil {
+			log.Errorf("Failed to apply configuration: %v", err)
+			continue
+		}
+		mqttClient.SubscribeTopics(false)
+	}
+}
@@ -0,0 +1,68 @@
+package decoder
+
+import (
+	"encoding/json"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// Default availability payload of an offline device
+const availabilityOffline = "offline"
+
+// availabilityPayload is the JSON availability payload of zigbee2mqtt.
+type availabilityPayload struct {
+	State string `json:"state"`
+}
+
+// offline reports whether an availability payload reports the device offline.
+// The comparison is case insensitive and the JSON {"state": "offline"}
+// payloads are understood.
+func offline(filter config.Sensor, payload []byte) bool {
+	state := strings.TrimSpace(string(payload))
+	var p availabilityPayload
+	if err := json.Unmarshal(payload, &p); err == nil && p.State != "" {
+		state = p.State
+	}
+	if len(filter.AvailabilityOffline) == 0 {
+		return strings.EqualFold(state, availabilityOffline)
+	}
+	for _, v := range filter.AvailabilityOffline {
+		if strings.EqualFold(state, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAvailability handles the messages matching the availabilityFilter of
+// a filter and reports whether the message is an availability message, which
+// is not evaluated by the filters. When the device is offline, the samples of
+// the filter having the labels extracted by the availabilityFilter are expired
+// or zeroed.
+func (d *Decoder) handleAvailability(msg mqtt.Message) bool {
+	handled := false
+	for _, vk := range d.index {
+		v := d.filters[vk]
+		if v.availability == nil {
+			continue
+		}
+		matches := getParams(v.availability, msg.Topic())
+		if matches == nil {
+			continue
+		}
+		handled = true
+		if !offline(v.Sensor, msg.Payload()) {
+			continue
+		}
+		labels := matchedLabels(matches, v.Sensor)
+		log.Debugf("Filter %s: device %v offline", vk, labels)
+		if d.OnUnavailable != nil {
+			d.OnUnavailable(vk, labels, v.Sensor.AvailabilityAction == config.AvailabilityActionZero)
+		}
+	}
+	return handled
+}
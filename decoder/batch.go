@@ -0,0 +1,88 @@
+package decoder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yalp/jsonpath"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+var BatchSkippedPoints = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mqtt_exporter_batch_points_skipped_total",
+		Help: "Number of readings of batch payloads which were not exposed because a newer reading of the batch was, by filter.",
+	},
+	[]string{"filter"},
+)
+
+// addBatchSamples decodes a payload holding an array of readings, found at the
+// batchPath of the filter, such as the backlog sent by a device after a loss of
+// connectivity. Only the newest reading is exposed, according to the
+// timestamp of the filter or the order of the array; the older ones are
+// counted, and forwarded to OnBackfill with batchRemoteWrite.
+func (d *Decoder) addBatchSamples(vk string, filter config.Sensor, topic string, matches map[string]string, dataValue interface{}) {
+	value, err := jsonpath.Read(dataValue, filter.BatchPath)
+	if err != nil {
+		reportPayloadError(vk, filter, payloadErrorJsonPath, topic, fmt.Errorf("%s: %v", filter.BatchPath, err))
+		return
+	}
+	points, ok := value.([]interface{})
+	if !ok {
+		reportPayloadError(vk, filter, payloadErrorJson, topic, fmt.Errorf("%s: not an array of readings", filter.BatchPath))
+		return
+	}
+	if len(points) == 0 {
+		return
+	}
+
+	newest := newestPoint(filter, points)
+	BatchSkippedPoints.WithLabelValues(vk).Add(float64(len(points) - 1))
+	if filter.BatchRemoteWrite && d.OnBackfill != nil && len(points) > 1 {
+		// The older readings are expected to be late, their clock skew is not
+		// checked. They are handed over together before the newest reading is
+		// exposed, which would make them out of order for the remote storage
+		var samples []*collector.Sample
+		backfill := d.withOutput(func(sample *collector.Sample) {
+			samples = append(samples, sample)
+		})
+		backfillFilter := filter
+		backfillFilter.MaxClockSkew = 0
+		for i, point := range points {
+			if i != newest {
+				backfill.addJsonSamples(vk, backfillFilter, topic, matches, matchedLabels(matches, filter), point)
+			}
+		}
+		d.OnBackfill(samples)
+	}
+	d.addJsonSamples(vk, filter, topic, matches, matchedLabels(matches, filter), points[newest])
+}
+
+// newestPoint returns the index of the reading with the most recent timestamp,
+// or of the last reading when the filter has no timestamp. The readings whose
+// timestamp cannot be read are ignored, their errors being reported when
+// they are decoded.
+func newestPoint(filter config.Sensor, points []interface{}) int {
+	if filter.Timestamp == "" {
+		return len(points) - 1
+	}
+	newest := len(points) - 1
+	var newestTime time.Time
+	for i, point := range points {
+		value, err := jsonpath.Read(point, filter.Timestamp)
+		if err != nil {
+			continue
+		}
+		timestamp, err := parseTimestamp(value, filter.TimestampFormat)
+		if err != nil {
+			continue
+		}
+		if newestTime.IsZero() || timestamp.After(newestTime) {
+			newest, newestTime = i, timestamp
+		}
+	}
+	return newest
+}
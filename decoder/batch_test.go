@@ -0,0 +1,50 @@
+package decoder
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// The older readings of a batch are backfilled together, before the newest
+// reading is exposed.
+func TestBatchBackfill(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics: []string{"meter/+"},
+		Sensors: map[string]config.Sensor{
+			"meter": {
+				PayloadType:      config.PayloadTypeJson,
+				Filter:           "^meter/(?P<Ldevice>[^/]+)$",
+				Values:           map[string]string{"power": "$.p"},
+				Timestamp:        "$.ts",
+				BatchPath:        "$",
+				BatchRemoteWrite: true,
+			},
+		},
+	}
+	var events []string
+	d := newTestDecoder(t, configuration, func(sample *collector.Sample) {
+		events = append(events, fmt.Sprintf("expose %v", sample.Value))
+	})
+	d.OnBackfill = func(samples []*collector.Sample) {
+		for _, sample := range samples {
+			events = append(events, fmt.Sprintf("backfill %v@%d", sample.Value, sample.Timestamp.Unix()))
+		}
+	}
+
+	d.HandleSubscription("meter/+", &testMessage{topic: "meter/main", payload: `[{"ts": 1700000120, "p": 3}, {"ts": 1700000000, "p": 1}, {"ts": 1700000060, "p": 2}]`})
+	want := []string{"backfill 1@1700000000", "backfill 2@1700000060", "expose 3"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+func TestBatchRemoteWriteRequiresTimestamp(t *testing.T) {
+	sensor := config.Sensor{PayloadType: config.PayloadTypeJson, Filter: "^meter/", BatchPath: "$", BatchRemoteWrite: true}
+	if !slices.Contains(sensor.Validate(), "batchRemoteWrite requires a timestamp") {
+		t.Errorf("Validate() = %v, want the missing timestamp reported", sensor.Validate())
+	}
+}
@@ -0,0 +1,77 @@
+package decoder
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// Name of the metric holding the clock skew of each device
+const clockSkewMetric = "mqtt_exporter_clock_skew_seconds"
+
+var ClockSkewExceeded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mqtt_exporter_clock_skew_exceeded_total",
+		Help: "Number of messages whose timestamp deviates from the reception time by more than the maximum clock skew, by filter.",
+	},
+	[]string{"filter"},
+)
+
+// checkClockSkew stores the skew between the reception time and the timestamp
+// of a message, with the labels of the message and the filter label, and
+// applies the clock skew policy of the filter when it exceeds maxClockSkew.
+// It returns the timestamp of the samples and whether they are kept.
+func (d *Decoder) checkClockSkew(vk string, filter config.Sensor, topic string, labels prometheus.Labels, timestamp time.Time) (time.Time, bool) {
+	now := time.Now()
+	skew := now.Sub(timestamp).Seconds()
+
+	skewLabels := make(prometheus.Labels, len(labels)+1)
+	for k, v := range labels {
+		skewLabels[k] = v
+	}
+	skewLabels["filter"] = vk
+	for k, v := range d.configuration.Labels {
+		if _, ok := skewLabels[k]; !ok {
+			skewLabels[k] = v
+		}
+	}
+	tenantName, tenant := d.tenant(topic)
+	id := metricKey("", clockSkewMetric, skewLabels)
+	if tenantName != "" {
+		id = tenantName + "/" + id
+	}
+	if !tenant.SeparateMetricsPath {
+		tenantName = ""
+	}
+	d.output(&collector.Sample{
+		Id:      id,
+		Name:    clockSkewMetric,
+		Labels:  skewLabels,
+		Help:    "Difference between the reception time and the timestamp of the last message of the device in seconds.",
+		Value:   skew,
+		Type:    prometheus.GaugeValue,
+		Expires: now.Add(time.Duration(d.configuration.PurgeDelay) * time.Second),
+
+		Topic:  topic,
+		Tenant: tenantName,
+	})
+
+	if math.Abs(skew) <= filter.MaxClockSkew {
+		return timestamp, true
+	}
+	ClockSkewExceeded.WithLabelValues(vk).Inc()
+	switch filter.ClockSkewPolicy {
+	case config.ClockSkewPolicyKeep:
+		return timestamp, true
+	case config.ClockSkewPolicyReceive:
+		log.Debugf("Filter %s: timestamp of %s skewed by %.3fs, replaced by the reception time", vk, topic, skew)
+		return time.Time{}, true
+	}
+	log.Debugf("Filter %s: dropped message from %s whose timestamp is skewed by %.3fs", vk, topic, skew)
+	return timestamp, false
+}
@@ -0,0 +1,122 @@
+package decoder
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// metricDefinition is a metric a filter may generate.
+type metricDefinition struct {
+	filter string
+	labels string
+	help   string
+}
+
+// filterLabelNames returns the sorted names of the labels generated by a
+// filter, excluding the labels common to every metric.
+func filterLabelNames(cfg *config.Configuration, filter config.Sensor, c *Filter) []string {
+	names := []string{}
+	for _, name := range c.Pattern.SubexpNames() {
+		if name != "" && name[0] == matchTypeLabel {
+			if filter.LabelsCleanupFirstCharacter {
+				name = name[1:]
+			}
+			names = append(names, name)
+		}
+	}
+	if filter.DeviceLabel != "" && !slices.Contains(names, filter.DeviceLabel) {
+		names = append(names, filter.DeviceLabel)
+	}
+	topicLabel := filter.TopicLabel
+	if topicLabel == "" {
+		topicLabel = cfg.TopicLabel
+	}
+	if topicLabel != "" && !slices.Contains(names, topicLabel) {
+		names = append(names, topicLabel)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkMetricCollisions detects the filters generating the same metric name
+// with different label sets or help strings, which Prometheus refuses at
+// scrape time. Metrics whose name or group is extracted from the topic, and
+// the metrics of custom decoders, cannot be checked.
+func checkMetricCollisions(cfg *config.Configuration, filters map[string]*Filter) []string {
+	keys := make([]string, 0, len(filters))
+	for k := range filters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	definitions := map[string]metricDefinition{}
+	collisions := []string{}
+	define := func(k string, group string, name string, labels []string) {
+		metric := MetricName(cfg.Prefix, group, name)
+		definition := metricDefinition{filter: k, labels: strings.Join(labels, ","), help: MetricHelp(group, name)}
+		previous, ok := definitions[metric]
+		if !ok {
+			definitions[metric] = definition
+			return
+		}
+		if previous.labels != definition.labels {
+			collisions = append(collisions, fmt.Sprintf("%s is defined by filters %s and %s with different labels (%s) and (%s)", metric, previous.filter, k, previous.labels, definition.labels))
+		} else if previous.help != definition.help {
+			collisions = append(collisions, fmt.Sprintf("%s is defined by filters %s and %s with different help strings %q and %q", metric, previous.filter, k, previous.help, definition.help))
+		}
+	}
+
+	for _, k := range keys {
+		filter := cfg.Sensors[k]
+		subexpNames := filters[k].Pattern.SubexpNames()
+		if slices.Contains(subexpNames, matchTypeName) {
+			continue
+		}
+
+		var group string
+		var names []string
+		switch filter.PayloadType {
+		case config.PayloadTypeJson:
+			group = filter.Group
+			for name := range filter.Values {
+				names = append(names, name)
+			}
+			for name := range filter.Histograms {
+				names = append(names, name)
+			}
+		case config.PayloadTypeRaw, config.PayloadTypeCollectd:
+			if slices.Contains(subexpNames, matchTypeGroup) {
+				continue
+			}
+			group = filter.Group
+			names = []string{filter.Name}
+		default:
+			// The names of the values of custom decoders are not known
+			continue
+		}
+		sort.Strings(names)
+
+		labels := filterLabelNames(cfg, filter, filters[k])
+		for _, name := range names {
+			define(k, group, name, labels)
+			if filter.NonNumeric == config.NonNumericInfo {
+				infoLabels := append(append([]string{}, labels...), "value")
+				sort.Strings(infoLabels)
+				define(k, group, name+"_info", infoLabels)
+			}
+		}
+		if len(filter.InfoLabels) > 0 {
+			infoLabels := append([]string{}, labels...)
+			for label := range filter.InfoLabels {
+				infoLabels = append(infoLabels, label)
+			}
+			sort.Strings(infoLabels)
+			define(k, group, deviceInfoName, infoLabels)
+		}
+	}
+	return collisions
+}
@@ -0,0 +1,77 @@
+package decoder
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+func TestCheckMetricCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		sensors map[string]config.Sensor
+		want    []string
+	}{
+		{
+			name: "same labels",
+			sensors: map[string]config.Sensor{
+				"kitchen": {PayloadType: config.PayloadTypeJson, Filter: "^kitchen/(?P<Ldevice>[^/]+)$", Values: map[string]string{"temperature": "$.t"}},
+				"garage":  {PayloadType: config.PayloadTypeJson, Filter: "^garage/(?P<Ldevice>[^/]+)$", Values: map[string]string{"temperature": "$.t"}},
+			},
+		},
+		{
+			name: "different groups",
+			sensors: map[string]config.Sensor{
+				"zigbee": {PayloadType: config.PayloadTypeJson, Filter: "^zigbee/(?P<Ldevice>[^/]+)$", Group: "zigbee", Values: map[string]string{"temperature": "$.t"}},
+				"shelly": {PayloadType: config.PayloadTypeJson, Filter: "^shelly/(?P<Lroom>[^/]+)$", Group: "shelly", Values: map[string]string{"temperature": "$.t"}},
+			},
+		},
+		{
+			name: "different labels",
+			sensors: map[string]config.Sensor{
+				"zigbee": {PayloadType: config.PayloadTypeJson, Filter: "^zigbee/(?P<Ldevice>[^/]+)$", Values: map[string]string{"temperature": "$.t"}},
+				"shelly": {PayloadType: config.PayloadTypeJson, Filter: "^shelly/(?P<Lroom>[^/]+)$", Values: map[string]string{"temperature": "$.t"}},
+			},
+			want: []string{"temperature is defined by filters shelly and zigbee with different labels (Lroom) and (Ldevice)"},
+		},
+		{
+			name: "different help strings",
+			sensors: map[string]config.Sensor{
+				"zigbee": {PayloadType: config.PayloadTypeJson, Filter: "^zigbee/(?P<Ldevice>[^/]+)$", Group: "home-zigbee", Values: map[string]string{"temp": "$.t"}},
+				"shelly": {PayloadType: config.PayloadTypeJson, Filter: "^shelly/(?P<Ldevice>[^/]+)$", Group: "home", Values: map[string]string{"zigbee_temp": "$.t"}},
+			},
+			want: []string{`home_zigbee_temp is defined by filters shelly and zigbee with different help strings "new mqttexporter: Name: 'home_zigbee_temp'" and "new mqttexporter: Name: 'home-zigbee_temp'"`},
+		},
+		{
+			name: "raw payloads",
+			sensors: map[string]config.Sensor{
+				"plug":   {PayloadType: config.PayloadTypeRaw, Filter: "^plug/(?P<Ldevice>[^/]+)/power$", Name: "power"},
+				"switch": {PayloadType: config.PayloadTypeRaw, Filter: "^switch/power$", Name: "power"},
+			},
+			want: []string{"power is defined by filters plug and switch with different labels (Ldevice) and ()"},
+		},
+		{
+			name: "names extracted from the topic",
+			sensors: map[string]config.Sensor{
+				"zigbee": {PayloadType: config.PayloadTypeRaw, Filter: "^zigbee/(?P<Ldevice>[^/]+)/(?P<N>[^/]+)$"},
+				"shelly": {PayloadType: config.PayloadTypeRaw, Filter: "^shelly/(?P<N>[^/]+)$"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		cfg := &config.Configuration{Sensors: tt.sensors}
+		filters := map[string]*Filter{}
+		for k, v := range tt.sensors {
+			filter, err := compileFilter(k, v)
+			if err != nil {
+				t.Fatalf("%s: compileFilter(%s): %v", tt.name, k, err)
+			}
+			filters[k] = filter
+		}
+		got := checkMetricCollisions(cfg, filters)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: checkMetricCollisions = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
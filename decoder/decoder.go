@@ -0,0 +1,1032 @@
+// Package decoder runs the MQTT messages through the configured filters and
+// decodes their payloads into samples.
+package decoder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/yalp/jsonpath"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+const (
+	matchTypeLabel = 'L'
+	matchTypeGroup = "G"
+	matchTypeName  = "N"
+)
+
+var (
+	LastPush = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "last_push_timestamp_seconds",
+			Help: "Unix timestamp of the last received metrics push in seconds.",
+		},
+	)
+	ParseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_parse_errors_total",
+			Help: "Number of values which could not be parsed as a number, by filter.",
+		},
+		[]string{"filter"},
+	)
+	OutOfRangeValues = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_out_of_range_values_total",
+			Help: "Number of values out of their bounds, NaN or infinite, by filter.",
+		},
+		[]string{"filter"},
+	)
+	ReceivedMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_messages_received_total",
+			Help: "Number of messages received from the MQTT broker.",
+		},
+	)
+	RateLimitedMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_messages_rate_limited_total",
+			Help: "Number of messages discarded by the per topic rate limits.",
+		},
+	)
+	ExcludedMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_messages_excluded_total",
+			Help: "Number of messages discarded by the global excludeTopics patterns or republished by the exporter.",
+		},
+	)
+	RelabelDroppedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_samples_relabel_dropped_total",
+			Help: "Number of samples dropped by the relabeling rules.",
+		},
+	)
+	OversizedMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_messages_oversized_total",
+			Help: "Number of messages discarded because their payload exceeds the maximum payload size.",
+		},
+	)
+	MessageFlags = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_messages_flags_total",
+			Help: "Number of messages received by subscription, retained flag, QoS and duplicate flag.",
+		},
+		[]string{"subscription", "retained", "qos", "duplicate"},
+	)
+)
+
+// Metrics returns the metrics about the decoding of the messages.
+func Metrics() []prometheus.Collector {
+	return []prometheus.Collector{LastPush, ParseErrors, PayloadErrors, OutOfRangeValues, ReceivedMessages, RateLimitedMessages, ExcludedMessages, OversizedMessages, DuplicateMessages, MessageFlags, RelabelDroppedSamples, ClockSkewExceeded, BatchSkippedPoints}
+}
+
+// Filter is a compiled filter of the configuration.
+type Filter struct {
+	Name    string
+	Sensor  config.Sensor
+	Pattern *regexp.Regexp
+
+	expressions  map[string]expression
+	windows      []timeWindow
+	availability *regexp.Regexp
+}
+
+// Decoder decodes the messages with the filters of the active configuration
+// and hands the resulting samples over to its output.
+type Decoder struct {
+	// OnUnavailable is called when an availability message reports a device
+	// offline, with the name of the filter and the labels identifying the
+	// device, to expire (or zero) its samples.
+	OnUnavailable func(filter string, labels map[string]string, zero bool)
+	// OnBackfill receives the samples of the older readings of the batch
+	// payloads of the filters with batchRemoteWrite, which are not exposed,
+	// before the newest reading of the batch is. It is called from the message
+	// handlers and must not block.
+	OnBackfill func(samples []*collector.Sample)
+	// OwnTopicPrefix is the prefix of the topics the exporter publishes its
+	// samples to, whose messages are excluded so that the exporter does not
+	// decode its own output. No topic is excluded when it is empty.
+	OwnTopicPrefix string
+
+	// mu guards configuration, filters, index and subscriptionFilters which
+	// are swapped when a configuration is applied.
+	mu                  sync.RWMutex
+	configuration       *config.Configuration
+	filters             map[string]*Filter
+	index               []string
+	subscriptionFilters map[string][]string
+	tenants             []string
+	relabelRules        []*relabelRule
+
+	// lastDelivery is the last message handed over to a subscription handler
+	deliveryMu   sync.Mutex
+	lastDelivery mqtt.Message
+
+	rateLimiter  *rateLimiter
+	deduplicator *deduplicator
+	homie        *homieState
+	output       func(sample *collector.Sample)
+}
+
+// New returns a decoder handing the samples over to output, with an empty
+// configuration.
+func New(output func(sample *collector.Sample)) *Decoder {
+	return &Decoder{
+		configuration:       &config.Configuration{},
+		filters:             map[string]*Filter{},
+		index:               []string{},
+		subscriptionFilters: map[string][]string{},
+		rateLimiter:         newRateLimiter(output),
+		deduplicator:        newDeduplicator(),
+		homie:               newHomieState(),
+		output:              output,
+	}
+}
+
+// Configuration returns the active configuration, which must not be modified.
+func (d *Decoder) Configuration() *config.Configuration {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.configuration
+}
+
+// Filters returns the active filters, in evaluation order.
+func (d *Decoder) Filters() []*Filter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	filters := make([]*Filter, len(d.index))
+	for i, k := range d.index {
+		filters[i] = d.filters[k]
+	}
+	return filters
+}
+
+// Group returns the metric group of the samples decoded by the filter, or
+// false when the group is extracted from the topic.
+func (f *Filter) Group() (string, bool) {
+	if slices.Contains(f.Pattern.SubexpNames(), matchTypeGroup) {
+		return "", false
+	}
+	return f.Sensor.Group, true
+}
+
+// SubscriptionFilters returns the names of the filters evaluated for the
+// messages received on a subscription.
+func (d *Decoder) SubscriptionFilters(subscription string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.subscriptionFilters[subscription]
+}
+
+// Handle runs a message through every filter.
+func (d *Decoder) Handle(msg mqtt.Message) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	d.handleMessage(msg, "", d.index)
+}
+
+// HandleSubscription runs a message received on a subscription through the
+// filters of the subscriptions matching its topic. The MQTT client calls the
+// handler of every matching subscription with the same message, which is only
+// handled by the first one so that overlapping subscriptions neither evaluate
+// a filter twice nor see the message as a duplicate.
+func (d *Decoder) HandleSubscription(subscription string, msg mqtt.Message) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if !d.firstDelivery(msg) {
+		return
+	}
+	d.handleMessage(msg, subscription, d.topicFilters(msg.Topic(), subscription))
+}
+
+// Dispatch runs a message through the filters of the subscriptions matching
+// its topic, as the MQTT handlers would, or through every filter.
+func (d *Decoder) Dispatch(msg mqtt.Message) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	d.handleMessage(msg, "", d.topicFilters(msg.Topic(), ""))
+}
+
+// firstDelivery reports whether a message is not the message handed over to
+// the previous subscription handler. The handlers of a message are called in
+// sequence with the same message.
+func (d *Decoder) firstDelivery(msg mqtt.Message) bool {
+	d.deliveryMu.Lock()
+	defer d.deliveryMu.Unlock()
+	if d.lastDelivery == msg {
+		return false
+	}
+	d.lastDelivery = msg
+	return true
+}
+
+// topicFilters returns the filters of the subscription and of the other
+// subscriptions matching a topic, in evaluation order, or every filter when
+// no subscription matches.
+func (d *Decoder) topicFilters(topic string, subscription string) []string {
+	matching := []string{}
+	for _, s := range d.configuration.Topics {
+		if s == subscription || TopicMatches(s, topic) {
+			matching = append(matching, s)
+		}
+	}
+	switch len(matching) {
+	case 0:
+		return d.index
+	case 1:
+		return d.subscriptionFilters[matching[0]]
+	}
+	selected := make(map[string]bool)
+	for _, s := range matching {
+		for _, k := range d.subscriptionFilters[s] {
+			selected[k] = true
+		}
+	}
+	filters := make([]string, 0, len(selected))
+	for _, k := range d.index {
+		if selected[k] {
+			filters = append(filters, k)
+		}
+	}
+	return filters
+}
+
+// subscriptionOf returns the first subscription matching a topic, or an empty
+// string when none does.
+func (d *Decoder) subscriptionOf(topic string) string {
+	for _, s := range d.configuration.Topics {
+		if TopicMatches(s, topic) {
+			return s
+		}
+	}
+	return ""
+}
+
+// Probe decodes a message with a single filter, or with every filter when
+// filter is empty, and returns the samples instead of handing them over to
+// the output. The rate limits and the dedup window do not apply.
+func (d *Decoder) Probe(msg mqtt.Message, filter string) ([]*collector.Sample, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	filters := d.index
+	if filter != "" {
+		if _, ok := d.filters[filter]; !ok {
+			return nil, fmt.Errorf("unknown filter %s", filter)
+		}
+		filters = []string{filter}
+	}
+
+	samples := []*collector.Sample{}
+	probe := d.withOutput(func(sample *collector.Sample) {
+		samples = append(samples, sample)
+	})
+	probe.handleMessage(msg, "", filters)
+	return samples, nil
+}
+
+// withOutput returns a decoder sharing the configuration of d which hands the
+// samples over to output, without rate limits nor dedup window.
+func (d *Decoder) withOutput(output func(sample *collector.Sample)) *Decoder {
+	return &Decoder{
+		configuration: d.configuration,
+		filters:       d.filters,
+		tenants:       d.tenants,
+		relabelRules:  d.relabelRules,
+		homie:         d.homie,
+		output:        output,
+
+		OwnTopicPrefix: d.OwnTopicPrefix,
+	}
+}
+
+// compileFilter validates a filter and compiles its pattern. All the problems
+// of the filter are reported.
+func compileFilter(k string, v config.Sensor) (*Filter, error) {
+	problems := v.Validate()
+	fre, err := regexp.Compile(v.Filter)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("invalid pattern %q: %v", v.Filter, err))
+	}
+	expressions, err := compileExpressions(v.Values)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	windows, err := compileTimeWindows(v.ActiveWindows)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for label := range v.InfoLabels {
+		if !labelNameRegexp.MatchString(label) {
+			problems = append(problems, fmt.Sprintf("invalid infoLabels label %q", label))
+		}
+	}
+	var availability *regexp.Regexp
+	if v.AvailabilityFilter != "" {
+		if availability, err = regexp.Compile(v.AvailabilityFilter); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid availabilityFilter %q: %v", v.AvailabilityFilter, err))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return &Filter{Name: k, Sensor: v, Pattern: fre, expressions: expressions, windows: windows, availability: availability}, nil
+}
+
+// Apply compiles the filters of newConfiguration and makes it the active
+// configuration. The active configuration is left untouched on error. Invalid
+// filters are skipped with a warning when skipInvalid is set.
+func (d *Decoder) Apply(newConfiguration *config.Configuration, skipInvalid bool) error {
+	log.Infof("Compiling %d filters", len(newConfiguration.Sensors))
+	newFilters := make(map[string]*Filter)
+	newIndex := []string{}
+	keys := make([]string, 0, len(newConfiguration.Sensors))
+	for k := range newConfiguration.Sensors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	invalid := 0
+	for _, k := range keys {
+		v := newConfiguration.Sensors[k]
+		if v.IsEnabled() {
+			c, err := compileFilter(k, v)
+			if err != nil {
+				if skipInvalid {
+					log.Warnf("Skipping invalid filter %s: %v", k, err)
+					continue
+				}
+				log.Errorf("Invalid filter %s: %v", k, err)
+				invalid++
+				continue
+			}
+			newFilters[k] = c
+			newIndex = append(newIndex, k)
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid filters", invalid)
+	}
+	for _, topic := range newConfiguration.ExcludeTopics {
+		if !config.ValidTopicFilter(topic) {
+			return fmt.Errorf("invalid excludeTopics pattern %q", topic)
+		}
+	}
+	newTenants, err := sortTenants(newConfiguration.Tenants)
+	if err != nil {
+		return err
+	}
+	newRelabelRules, err := compileRelabelConfigs(newConfiguration.RelabelConfigs)
+	if err != nil {
+		return err
+	}
+	for _, name := range newConfiguration.LastSeenLabels {
+		if !labelNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid lastSeenLabels label %q", name)
+		}
+	}
+	if collisions := checkMetricCollisions(newConfiguration, newFilters); len(collisions) > 0 {
+		for _, collision := range collisions {
+			log.Errorf("Metric collision: %s", collision)
+		}
+		return fmt.Errorf("%d metric collisions", len(collisions))
+	}
+
+	// Sort sensors by Order
+	sort.Slice(newIndex, func(i, j int) bool {
+		return newConfiguration.Sensors[newIndex[i]].Order < newConfiguration.Sensors[newIndex[j]].Order
+	})
+
+	// Subscribe to the topics the filters are bound to, to the response
+	// topics of the polled filters and to the Homie devices
+	configured := newConfiguration.Topics
+	for _, k := range newIndex {
+		newConfiguration.Topics = mergeTopics(newConfiguration.Topics, newConfiguration.Sensors[k].Subscriptions, "subscription of filter "+k)
+		responseTopic := newConfiguration.Sensors[k].ResponseTopic
+		if responseTopic == "" || slices.ContainsFunc(configured, func(topic string) bool { return TopicMatches(topic, responseTopic) }) {
+			continue
+		}
+		newConfiguration.Topics = mergeTopics(newConfiguration.Topics, []string{responseTopic}, "response topic of filter "+k)
+	}
+	if newConfiguration.Homie.Enabled {
+		newConfiguration.Topics = mergeTopics(newConfiguration.Topics, []string{homieBaseTopic(newConfiguration.Homie) + "/#"}, "Homie devices")
+	}
+
+	if newConfiguration.AutoTopics {
+		filters := make([]string, 0, len(newIndex))
+		for _, k := range newIndex {
+			filters = append(filters, newConfiguration.Sensors[k].Filter)
+		}
+		newConfiguration.Topics = mergeTopics(newConfiguration.Topics, deriveTopics(filters), "derived from the filters")
+	}
+
+	// Associate to each subscription the filters bound to it, or able to match
+	// its topics for the filters not bound to any subscription
+	newSubscriptionFilters := make(map[string][]string)
+	subscribed := make(map[string]bool)
+	for _, topic := range newConfiguration.Topics {
+		filters := []string{}
+		for _, k := range newIndex {
+			bound := newConfiguration.Sensors[k].Subscriptions
+			if len(bound) > 0 && slices.Contains(bound, topic) || len(bound) == 0 && filterCanMatch(newConfiguration.Sensors[k].Filter, newFilters[k].Pattern, topic) {
+				filters = append(filters, k)
+				subscribed[k] = true
+			}
+		}
+		log.Infof("Topic %s: %d/%d filters", topic, len(filters), len(newIndex))
+		newSubscriptionFilters[topic] = filters
+	}
+	for _, k := range newIndex {
+		if !subscribed[k] {
+			log.Warnf("Filter %s (%s) does not match any subscribed topic", k, newConfiguration.Sensors[k].Filter)
+		}
+	}
+
+	d.mu.Lock()
+	d.configuration = newConfiguration
+	d.filters = newFilters
+	d.index = newIndex
+	d.subscriptionFilters = newSubscriptionFilters
+	d.tenants = newTenants
+	d.relabelRules = newRelabelRules
+	d.mu.Unlock()
+
+	log.Infof("Started %d filters", len(newIndex))
+	return nil
+}
+
+// sortTenants validates the tenants and returns their names, the longest topic
+// prefixes first.
+func sortTenants(tenants map[string]config.Tenant) ([]string, error) {
+	names := make([]string, 0, len(tenants))
+	for name, tenant := range tenants {
+		problems := tenant.Validate()
+		if name == "" || strings.Contains(name, "/") {
+			problems = append(problems, "the name must not be empty or contain /")
+		}
+		if len(problems) > 0 {
+			return nil, fmt.Errorf("invalid tenant %q: %s", name, strings.Join(problems, "; "))
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := tenants[names[i]].TopicPrefix, tenants[names[j]].TopicPrefix
+		if len(pi) != len(pj) {
+			return len(pi) > len(pj)
+		}
+		return names[i] < names[j]
+	})
+	return names, nil
+}
+
+// tenant returns the name of the tenant of a topic, empty when the topic does
+// not belong to a tenant.
+func (d *Decoder) tenant(topic string) (string, config.Tenant) {
+	for _, name := range d.tenants {
+		if tenant := d.configuration.Tenants[name]; strings.HasPrefix(topic, tenant.TopicPrefix) {
+			return name, tenant
+		}
+	}
+	return "", config.Tenant{}
+}
+
+// MetricName returns the name of the metric of a value, prefixed with the
+// prefix of the configuration.
+func MetricName(prefix string, group string, name string) string {
+	result := prefix
+	if group != "" {
+		result += fmt.Sprintf("%s_%s", strings.ReplaceAll(group, "-", "_"), strings.ReplaceAll(name, "-", "_"))
+		return result
+	} else {
+		result += strings.ReplaceAll(name, "-", "_")
+		return result
+	}
+}
+
+// MetricHelp returns the help string of the metric of a value.
+func MetricHelp(group string, name string) string {
+	if group != "" {
+		return fmt.Sprintf("new mqttexporter: Name: '%s_%s'", group, name)
+	} else {
+		return fmt.Sprintf("new mqttexporter: Name: '%s'", name)
+	}
+}
+
+func metricType(m config.Sensor) (prometheus.ValueType, error) {
+	return prometheus.GaugeValue, nil
+}
+
+func metricKey(group string, name string, labels prometheus.Labels) string {
+	if group != "" {
+		return fmt.Sprintf("%s-%s-%v", group, name, labels)
+	} else {
+		return fmt.Sprintf("%s-%v", name, labels)
+	}
+}
+
+func getParams(regEx *regexp.Regexp, url string) (paramsMap map[string]string) {
+
+	match := regEx.FindStringSubmatch(url)
+	if match == nil {
+		return nil
+	}
+
+	paramsMap = make(map[string]string)
+	for i, name := range regEx.SubexpNames() {
+		if i > 0 && i <= len(match) {
+			paramsMap[name] = match[i]
+		}
+	}
+	return paramsMap
+}
+
+// storeSample hands a sample produced by the filter vk over to the output.
+func (d *Decoder) storeSample(vk string, filter config.Sensor, sample *collector.Sample) {
+	for k, v := range d.configuration.Labels {
+		if _, ok := sample.Labels[k]; !ok {
+			sample.Labels[k] = v
+		}
+	}
+	if filter.RateLimitMode == config.RateLimitModeAverage && filter.RateLimitInterval > 0 && d.rateLimiter != nil {
+		d.rateLimiter.aggregate(sample, filter)
+		return
+	}
+	d.output(sample)
+}
+
+// Name of the metric holding the time of the last message of each device
+const lastSeenMetric = "mqtt_exporter_last_message_timestamp_seconds"
+
+// storeLastSeen stores the time of the last message of the device identified
+// by the lastSeenLabels of the labels of a sample, without its info labels.
+// The global labels are taken into account. The samples of a tenant are
+// exposed on its own metrics path when separate is set.
+func (d *Decoder) storeLastSeen(labels prometheus.Labels, tenant string, separate bool, topic string, now time.Time) {
+	if len(d.configuration.LastSeenLabels) == 0 {
+		return
+	}
+	lastSeenLabels := make(prometheus.Labels, len(d.configuration.LastSeenLabels))
+	identified := false
+	for _, name := range d.configuration.LastSeenLabels {
+		value, ok := labels[name]
+		if !ok {
+			value = d.configuration.Labels[name]
+		}
+		lastSeenLabels[name] = value
+		identified = identified || value != ""
+	}
+	if !identified {
+		return
+	}
+
+	// Without purge delay, the devices are never forgotten
+	expires := now.AddDate(100, 0, 0)
+	if d.configuration.LastSeenPurgeDelay > 0 {
+		expires = now.Add(time.Duration(d.configuration.LastSeenPurgeDelay) * time.Second)
+	}
+	id := metricKey("", lastSeenMetric, lastSeenLabels)
+	if tenant != "" {
+		id = tenant + "/" + id
+	}
+	if !separate {
+		tenant = ""
+	}
+	d.output(&collector.Sample{
+		Id:      id,
+		Name:    lastSeenMetric,
+		Labels:  lastSeenLabels,
+		Help:    "Unix timestamp of the last message received from the device in seconds.",
+		Value:   float64(now.UnixNano()) / 1e9,
+		Type:    prometheus.GaugeValue,
+		Expires: expires,
+
+		Topic:  topic,
+		Tenant: tenant,
+	})
+}
+
+func matchedName(matches map[string]string, name string) string {
+	if v := matches[matchTypeName]; v != "" {
+		return v
+	}
+	return name
+}
+
+func matchedGroup(matches map[string]string, group string) string {
+	if v := matches[matchTypeGroup]; v != "" {
+		return v
+	}
+	return group
+}
+
+// matchedLabels returns the labels extracted from the topic by the filter
+// (named groups starting with L).
+func matchedLabels(matches map[string]string, filter config.Sensor) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for kMatches, vMatches := range matches {
+		if kMatches != "" && kMatches[0] == matchTypeLabel {
+			if filter.LabelsCleanupFirstCharacter {
+				kMatches = kMatches[1:]
+			}
+			labels[kMatches] = vMatches
+		}
+	}
+	return labels
+}
+
+// addSample converts a decoded value following the non numeric value policy
+// of the filter and stores the resulting sample.
+func (d *Decoder) addSample(vk string, filter config.Sensor, topic string, group string, name string, labels prometheus.Labels, value interface{}, timestamp time.Time) {
+	pvalue, infoValue, keep := convertValue(vk, filter, value)
+	if !keep {
+		return
+	}
+	if infoValue == "" {
+		if pvalue, keep = checkBounds(vk, filter, name, pvalue); !keep {
+			return
+		}
+	}
+	var infoLabels prometheus.Labels
+	if infoValue != "" {
+		name += "_info"
+		infoLabels = prometheus.Labels{"value": infoValue}
+	}
+	d.storeValue(vk, filter, topic, group, name, labels, infoLabels, pvalue, nil, timestamp)
+}
+
+// storeValue stores a sample, a histogram sample when histogram is not nil.
+// The topic is added as a label when a topic label is configured. The info
+// labels are not part of the id of the sample, so that a single series is kept
+// whatever their values.
+func (d *Decoder) storeValue(vk string, filter config.Sensor, topic string, group string, name string, labels prometheus.Labels, infoLabels prometheus.Labels, pvalue float64, histogram *collector.Histogram, timestamp time.Time) {
+	topicLabel := filter.TopicLabel
+	if topicLabel == "" {
+		topicLabel = d.configuration.TopicLabel
+	}
+	if _, ok := labels[topicLabel]; topicLabel != "" && !ok {
+		labels[topicLabel] = topic
+	}
+	prefix := d.configuration.Prefix
+	tenantName, tenant := d.tenant(topic)
+	if tenantName != "" {
+		if tenant.Prefix != "" {
+			prefix = tenant.Prefix
+		}
+		for k, v := range tenant.Labels {
+			if _, ok := labels[k]; !ok {
+				labels[k] = v
+			}
+		}
+	}
+	metricName := MetricName(prefix, group, name)
+	help := MetricHelp(group, name)
+	id := ""
+	if len(d.relabelRules) > 0 {
+		for k, v := range d.configuration.Labels {
+			if _, ok := labels[k]; !ok {
+				labels[k] = v
+			}
+		}
+		labels[metricNameLabel] = metricName
+		if !relabel(d.relabelRules, labels) {
+			RelabelDroppedSamples.Inc()
+			log.Debugf("Filter %s: sample %s dropped by relabeling", vk, metricName)
+			return
+		}
+		renamed := labels[metricNameLabel]
+		delete(labels, metricNameLabel)
+		if renamed != metricName {
+			if !model.IsValidMetricName(model.LabelValue(renamed)) {
+				RelabelDroppedSamples.Inc()
+				log.Warnf("Filter %s: sample %s dropped, invalid metric name %q after relabeling", vk, metricName, renamed)
+				return
+			}
+			// Metrics renamed to the same name must share their help
+			metricName = renamed
+			help = MetricHelp("", renamed)
+			id = metricKey("", metricName, labels)
+		}
+	}
+	if id == "" {
+		id = metricKey(group, name, labels)
+	}
+	if tenantName != "" {
+		id = tenantName + "/" + id
+	}
+
+	now := time.Now()
+	LastPush.Set(float64(now.UnixNano()) / 1e9)
+	metricType, err := metricType(filter)
+	if err != nil {
+		log.Error("metricType failure: ", err)
+		return
+	}
+	d.storeLastSeen(labels, tenantName, tenant.SeparateMetricsPath, topic, now)
+	if !tenant.SeparateMetricsPath {
+		tenantName = ""
+	}
+	for k, v := range infoLabels {
+		labels[k] = v
+	}
+	log.Debugf("Adding metric %s", id)
+	d.storeSample(vk, filter, &collector.Sample{
+		Id:      id,
+		Name:    metricName,
+		Labels:  labels,
+		Help:    help,
+		Value:   pvalue,
+		Type:    metricType,
+		Expires: now.Add(time.Duration(d.configuration.PurgeDelay) * time.Second),
+
+		Timestamp: timestamp,
+		Topic:     topic,
+		Tenant:    tenantName,
+		Filter:    vk,
+		Group:     group,
+		Histogram: histogram,
+	})
+}
+
+// Name of the metric holding the infoLabels of the devices
+const deviceInfoName = "device_info"
+
+// infoLabelValue formats a decoded JSON value as a label value.
+func infoLabelValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	content, _ := json.Marshal(value)
+	return string(content)
+}
+
+// addJsonSamples stores a sample for each value of the filter found in a
+// decoded JSON object, or computed by its expression, the device_info sample
+// of the infoLabels and the histograms. On error, no value is stored with the
+// drop policy.
+func (d *Decoder) addJsonSamples(vk string, filter config.Sensor, topic string, matches map[string]string, labels prometheus.Labels, dataValue interface{}) {
+	values := make(map[string]interface{}, len(filter.Values))
+	failed := false
+	var timestamp time.Time
+	if filter.Timestamp != "" {
+		var errTime error
+		var value, errPath = jsonpath.Read(dataValue, filter.Timestamp)
+		if errPath == nil {
+			timestamp, errTime = parseTimestamp(value, filter.TimestampFormat)
+		} else {
+			errTime = fmt.Errorf("%s: %v", filter.Timestamp, errPath)
+		}
+		if errTime != nil {
+			failed = true
+			reportPayloadError(vk, filter, payloadErrorTimestamp, topic, errTime)
+		}
+	}
+	var expressions map[string]expression
+	if f, ok := d.filters[vk]; ok {
+		expressions = f.expressions
+	}
+	for vname, vpath := range filter.Values {
+		if e, ok := expressions[vname]; ok {
+			value, errExpr := e(dataValue)
+			if errExpr != nil {
+				failed = true
+				reportPayloadError(vk, filter, payloadErrorExpr, topic, fmt.Errorf("%s: %v", vname, errExpr))
+				continue
+			}
+			values[vname] = value
+			continue
+		}
+		var value, errPath = jsonpath.Read(dataValue, vpath)
+		if errPath != nil {
+			failed = true
+			reportPayloadError(vk, filter, payloadErrorJsonPath, topic, fmt.Errorf("%s: %v", vpath, errPath))
+			continue
+		}
+		if value != nil {
+			values[vname] = value
+		}
+	}
+	var infoLabels prometheus.Labels
+	if len(filter.InfoLabels) > 0 {
+		infoLabels = make(prometheus.Labels, len(filter.InfoLabels))
+		for label, path := range filter.InfoLabels {
+			var value, errPath = jsonpath.Read(dataValue, path)
+			if errPath != nil {
+				failed = true
+				reportPayloadError(vk, filter, payloadErrorJsonPath, topic, fmt.Errorf("%s: %v", path, errPath))
+				continue
+			}
+			infoLabels[label] = infoLabelValue(value)
+		}
+	}
+	histograms := make(map[string]*collector.Histogram, len(filter.Histograms))
+	for hname, h := range filter.Histograms {
+		histogram, errHistogram := decodeHistogram(h, dataValue)
+		if errHistogram != nil {
+			failed = true
+			reportPayloadError(vk, filter, payloadErrorHistogram, topic, fmt.Errorf("%s: %v", hname, errHistogram))
+			continue
+		}
+		histograms[hname] = histogram
+	}
+	if failed && filter.OnError == config.OnErrorDrop {
+		log.Debugf("Dropped message from topic: %s", topic)
+		return
+	}
+	if !timestamp.IsZero() && filter.MaxClockSkew > 0 {
+		var keep bool
+		if timestamp, keep = d.checkClockSkew(vk, filter, topic, labels, timestamp); !keep {
+			return
+		}
+	}
+	if infoLabels != nil {
+		sampleLabels := make(prometheus.Labels, len(labels))
+		for k, v := range labels {
+			sampleLabels[k] = v
+		}
+		d.storeValue(vk, filter, topic, filter.Group, deviceInfoName, sampleLabels, infoLabels, 1, nil, timestamp)
+	}
+	for hname, histogram := range histograms {
+		sampleLabels := make(prometheus.Labels, len(labels))
+		for k, v := range labels {
+			sampleLabels[k] = v
+		}
+		d.storeValue(vk, filter, topic, filter.Group, matchedName(matches, hname), sampleLabels, nil, histogram.Sum, histogram, timestamp)
+	}
+	for vname, value := range values {
+		name := matchedName(matches, vname)
+		log.Debugf("Matched filter %s - topic: %s => %s - %s = %v", vk, topic, matches, name, value)
+		// Each sample owns its labels
+		sampleLabels := make(prometheus.Labels, len(labels))
+		for k, v := range labels {
+			sampleLabels[k] = v
+		}
+		d.addSample(vk, filter, topic, filter.Group, name, sampleLabels, value, timestamp)
+	}
+}
+
+// addDecodedSamples stores a sample for each value decoded by the decoder of
+// a custom payloadType. On error, no value is stored with the drop policy.
+func (d *Decoder) addDecodedSamples(vk string, filter config.Sensor, topic string, matches map[string]string, pd PayloadDecoder, data []byte) {
+	values, err := pd.Decode(topic, data)
+	if err != nil {
+		reportPayloadError(vk, filter, payloadErrorDecoder, topic, err)
+		if filter.OnError == config.OnErrorDrop {
+			log.Debugf("Dropped message from topic: %s", topic)
+			return
+		}
+	}
+	for _, value := range values {
+		name := value.Name
+		if name == "" {
+			name = matchedName(matches, filter.Name)
+		}
+		labels := matchedLabels(matches, filter)
+		for k, v := range value.Labels {
+			labels[k] = v
+		}
+		d.addSample(vk, filter, topic, matchedGroup(matches, filter.Group), name, labels, value.Value, value.Timestamp)
+	}
+}
+
+// excluded reports whether a topic matches one of the exclusion patterns.
+func excluded(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if TopicMatches(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMessage runs the message received on a subscription, empty when it
+// is not known, through the given filters, in order, until one of them matches
+// the topic. d.mu must be held by the caller.
+func (d *Decoder) handleMessage(msg mqtt.Message, subscription string, filters []string) {
+	ReceivedMessages.Inc()
+	if excluded(d.configuration.ExcludeTopics, msg.Topic()) || (d.OwnTopicPrefix != "" && strings.HasPrefix(msg.Topic(), d.OwnTopicPrefix)) {
+		ExcludedMessages.Inc()
+		log.Debugf("Excluded message from topic: %s", msg.Topic())
+		return
+	}
+	if d.configuration.MessageFlagsMetrics {
+		if subscription == "" {
+			subscription = d.subscriptionOf(msg.Topic())
+		}
+		MessageFlags.WithLabelValues(subscription, strconv.FormatBool(msg.Retained()), strconv.Itoa(int(msg.Qos())), strconv.FormatBool(msg.Duplicate())).Inc()
+	}
+	var data = msg.Payload()
+	if d.configuration.MaxPayloadSize > 0 && len(data) > d.configuration.MaxPayloadSize {
+		OversizedMessages.Inc()
+		log.Debugf("Discarded message of %d bytes from topic: %s", len(data), msg.Topic())
+		return
+	}
+	if d.deduplicator.duplicate(msg.Topic(), data, time.Duration(d.configuration.DedupWindow*float64(time.Second))) {
+		DuplicateMessages.Inc()
+		log.Debugf("Discarded duplicate message from topic: %s", msg.Topic())
+		return
+	}
+	if d.configuration.Homie.Enabled && d.handleHomie(msg) {
+		return
+	}
+	if d.handleAvailability(msg) {
+		return
+	}
+	var stData = string(data[:])
+	now := time.Now()
+	for _, vk := range filters {
+		v := d.filters[vk]
+		log.Debugf("Matching sensor %s", vk)
+		if excluded(v.Sensor.ExcludeTopics, msg.Topic()) || !activeAt(v.windows, now) {
+			continue
+		}
+		matches := getParams(v.Pattern, msg.Topic())
+		if matches != nil {
+			var filter = v.Sensor
+			if !d.rateLimiter.allow(vk, msg.Topic(), filter) {
+				log.Debugf("Rate limited message from topic: %s", msg.Topic())
+				RateLimitedMessages.Inc()
+				break
+			}
+
+			var err error
+			var dataValue interface{}
+			if filter.PayloadType == config.PayloadTypeRaw {
+				log.Debugf("Received Raw message: %s from topic: %s", stData, msg.Topic())
+				name := matchedName(matches, filter.Name)
+				group := matchedGroup(matches, filter.Group)
+				d.addSample(vk, filter, msg.Topic(), group, name, matchedLabels(matches, filter), stData, time.Time{})
+			}
+
+			if filter.PayloadType == config.PayloadTypeCollectd {
+				log.Debugf("Received Raw message: %s from topic: %s", stData, msg.Topic())
+				name := matchedName(matches, filter.Name)
+				group := matchedGroup(matches, filter.Group)
+
+				var pvalues, errParse = ParseCollectd(stData)
+				if errParse == nil {
+					for index, pvalue := range pvalues {
+						labels := matchedLabels(matches, filter)
+						if len(pvalues) > 1 {
+							labels["V"] = fmt.Sprintf("%d", index)
+						}
+						d.addSample(vk, filter, msg.Topic(), group, name, labels, pvalue, time.Time{})
+					}
+				} else {
+					ParseErrors.WithLabelValues(vk).Inc()
+					log.Error("parseValueCollectd failure: ", errParse)
+				}
+			}
+			if filter.PayloadType == config.PayloadTypeJson {
+				log.Debugf("Received JSON message: %s from topic: %s", stData, msg.Topic())
+				err = json.Unmarshal(data, &dataValue)
+				if err == nil && filter.DeviceLabel != "" {
+					devices, ok := dataValue.(map[string]interface{})
+					if !ok {
+						reportPayloadError(vk, filter, payloadErrorJson, msg.Topic(), errors.New("payload is not an object keyed by device"))
+					}
+					for device, deviceValue := range devices {
+						if _, ok := deviceValue.(map[string]interface{}); !ok {
+							log.Debugf("Filter %s: skipping %s which is not a device object", vk, device)
+							continue
+						}
+						labels := matchedLabels(matches, filter)
+						labels[filter.DeviceLabel] = device
+						d.addJsonSamples(vk, filter, msg.Topic(), matches, labels, deviceValue)
+					}
+				} else if err == nil && filter.BatchPath != "" {
+					d.addBatchSamples(vk, filter, msg.Topic(), matches, dataValue)
+				} else if err == nil {
+					d.addJsonSamples(vk, filter, msg.Topic(), matches, matchedLabels(matches, filter), dataValue)
+				} else {
+					reportPayloadError(vk, filter, payloadErrorJson, msg.Topic(), err)
+				}
+			}
+			if pd := payloadDecoder(filter.PayloadType); pd != nil {
+				log.Debugf("Received %s message from topic: %s", filter.PayloadType, msg.Topic())
+				d.addDecodedSamples(vk, filter, msg.Topic(), matches, pd, data)
+			}
+			log.Debug("Matched")
+			break
+		}
+	}
+}
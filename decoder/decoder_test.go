@@ -0,0 +1,181 @@
+package decoder
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// testMessage implements mqtt.Message.
+type testMessage struct {
+	topic   string
+	payload string
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 0 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *testMessage) Ack()              {}
+
+// newTestDecoder returns a decoder applying configuration, handing the samples
+// over to output.
+func newTestDecoder(t *testing.T, configuration *config.Configuration, output func(sample *collector.Sample)) *Decoder {
+	t.Helper()
+	if output == nil {
+		output = func(*collector.Sample) {}
+	}
+	d := New(output)
+	if err := d.Apply(configuration, false); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	return d
+}
+
+// probeSamples decodes a message with every filter of the configuration and
+// returns the values of the samples by metric name.
+func probeSamples(t *testing.T, configuration *config.Configuration, topic string, payload string) map[string]float64 {
+	t.Helper()
+	samples, err := newTestDecoder(t, configuration, nil).Probe(&testMessage{topic: topic, payload: payload}, "")
+	if err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	values := make(map[string]float64, len(samples))
+	for _, sample := range samples {
+		values[sample.Name] = sample.Value
+	}
+	return values
+}
+
+// The handlers of overlapping subscriptions are called with the same message,
+// whose filters are evaluated once.
+func TestOverlappingSubscriptions(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics: []string{"#", "zigbee/+"},
+		Sensors: map[string]config.Sensor{
+			"any": {PayloadType: config.PayloadTypeJson, Filter: "^zigbee/(?P<Ldevice>[^/]+)$", Values: map[string]string{"temp": "$.t"}},
+		},
+	}
+	samples := map[string]int{}
+	d := newTestDecoder(t, configuration, func(sample *collector.Sample) {
+		samples[sample.Name]++
+	})
+	received := testutil.ToFloat64(ReceivedMessages)
+	msg := &testMessage{topic: "zigbee/kitchen", payload: `{"t": 21}`}
+	for _, subscription := range d.Configuration().Topics {
+		if TopicMatches(subscription, msg.Topic()) {
+			d.HandleSubscription(subscription, msg)
+		}
+	}
+	if got := testutil.ToFloat64(ReceivedMessages) - received; got != 1 {
+		t.Errorf("received messages = %v, want 1", got)
+	}
+	if samples["temp"] != 1 {
+		t.Errorf("filter any evaluated %d times, want 1", samples["temp"])
+	}
+}
+
+// The samples republished by the exporter are not decoded again.
+func TestOwnTopicPrefix(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics: []string{"#"},
+		Sensors: map[string]config.Sensor{
+			"any": {PayloadType: config.PayloadTypeJson, Filter: "^(?P<Ldevice>[^/]+)/(?P<Mname>[^/]+)$", Values: map[string]string{"value": "$.value"}},
+		},
+	}
+	samples := 0
+	d := newTestDecoder(t, configuration, func(sample *collector.Sample) {
+		samples++
+	})
+	d.OwnTopicPrefix = "metrics/"
+	excluded := testutil.ToFloat64(ExcludedMessages)
+
+	d.HandleSubscription("#", &testMessage{topic: "metrics/temperature", payload: `{"value": 21}`})
+	if samples != 0 {
+		t.Errorf("republished sample decoded again")
+	}
+	if got := testutil.ToFloat64(ExcludedMessages) - excluded; got != 1 {
+		t.Errorf("excluded messages = %v, want 1", got)
+	}
+	d.HandleSubscription("#", &testMessage{topic: "kitchen/temperature", payload: `{"value": 21}`})
+	if samples == 0 {
+		t.Errorf("message outside of the prefix not decoded")
+	}
+}
+
+// The message flags are counted by subscription, not by topic.
+func TestMessageFlagsBySubscription(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics:              []string{"zigbee/#"},
+		MessageFlagsMetrics: true,
+		Sensors: map[string]config.Sensor{
+			"zigbee": {PayloadType: config.PayloadTypeJson, Filter: "^zigbee/(?P<Ldevice>[^/]+)$", Values: map[string]string{"temp": "$.t"}},
+		},
+	}
+	d := newTestDecoder(t, configuration, nil)
+	MessageFlags.Reset()
+	d.HandleSubscription("zigbee/#", &testMessage{topic: "zigbee/kitchen", payload: `{"t": 21}`})
+	d.HandleSubscription("zigbee/#", &testMessage{topic: "zigbee/garage", payload: `{"t": 12}`})
+	d.Dispatch(&testMessage{topic: "zigbee/attic", payload: `{"t": 8}`})
+
+	if got := testutil.CollectAndCount(MessageFlags); got != 1 {
+		t.Errorf("got %d series, want 1", got)
+	}
+	if got := testutil.ToFloat64(MessageFlags.WithLabelValues("zigbee/#", "false", "0", "false")); got != 3 {
+		t.Errorf("zigbee/# messages = %v, want 3", got)
+	}
+}
+
+// The last message timestamps are identified by tenant, whether the tenants
+// are exposed on their own metrics path or not, and by the labels of the
+// topic only.
+func TestLastSeen(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics:         []string{"#"},
+		LastSeenLabels: []string{"device", "firmware"},
+		Tenants: map[string]config.Tenant{
+			"home":   {TopicPrefix: "home/"},
+			"office": {TopicPrefix: "office/", SeparateMetricsPath: true},
+			"lab":    {TopicPrefix: "lab/"},
+		},
+		Sensors: map[string]config.Sensor{
+			"any": {PayloadType: config.PayloadTypeJson, Filter: "^[^/]+/(?P<Ldevice>[^/]+)$", LabelsCleanupFirstCharacter: true, Values: map[string]string{"temp": "$.t"}, InfoLabels: map[string]string{"firmware": "$.fw"}},
+		},
+	}
+	lastSeen := map[string]*collector.Sample{}
+	d := newTestDecoder(t, configuration, func(sample *collector.Sample) {
+		if sample.Name == lastSeenMetric {
+			lastSeen[sample.Id] = sample
+		}
+	})
+	for _, topic := range []string{"home/kitchen", "office/kitchen", "lab/kitchen"} {
+		d.HandleSubscription("#", &testMessage{topic: topic, payload: `{"t": 21, "fw": "1.0"}`})
+		d.HandleSubscription("#", &testMessage{topic: topic, payload: `{"t": 21, "fw": "1.1"}`})
+	}
+
+	if len(lastSeen) != 3 {
+		t.Fatalf("got %d last message timestamps, want 3", len(lastSeen))
+	}
+	tenants := map[string]bool{}
+	for id, sample := range lastSeen {
+		tenants[sample.Tenant] = true
+		if sample.Labels["firmware"] != "" {
+			t.Errorf("%s: firmware info label %q taken into account", id, sample.Labels["firmware"])
+		}
+	}
+	if !tenants[""] || !tenants["office"] || len(tenants) != 2 {
+		t.Errorf("exposed by the tenants %v, want the collector and office", tenants)
+	}
+}
@@ -0,0 +1,65 @@
+package decoder
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var DuplicateMessages = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mqtt_exporter_messages_duplicate_total",
+		Help: "Number of messages discarded as duplicates of a message received within the dedup window.",
+	},
+)
+
+// deduplicator discards the messages whose topic and payload are identical to
+// those of a message received within the dedup window, such as QoS 1
+// redeliveries or messages received through several bridges.
+type deduplicator struct {
+	mu      sync.Mutex
+	expires map[uint64]time.Time
+}
+
+func newDeduplicator() *deduplicator {
+	d := &deduplicator{expires: map[uint64]time.Time{}}
+	go d.flush()
+	return d
+}
+
+// duplicate reports whether a message is a duplicate. No message is a
+// duplicate for a nil deduplicator.
+func (d *deduplicator) duplicate(topic string, payload []byte, window time.Duration) bool {
+	if d == nil || window <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	key := h.Sum64()
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if expires, ok := d.expires[key]; ok && now.Before(expires) {
+		return true
+	}
+	d.expires[key] = now.Add(window)
+	return false
+}
+
+// flush periodically forgets the messages whose window is over.
+func (d *deduplicator) flush() {
+	for now := range time.Tick(time.Second) {
+		d.mu.Lock()
+		for k, expires := range d.expires {
+			if !now.Before(expires) {
+				delete(d.expires, k)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
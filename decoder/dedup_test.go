@@ -0,0 +1,40 @@
+package decoder
+
+import (
+	"testing"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// A message delivered to the handlers of overlapping subscriptions is not a
+// duplicate, a redelivered message is.
+func TestDedupOverlappingSubscriptions(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics:      []string{"#"},
+		DedupWindow: 10,
+		Sensors: map[string]config.Sensor{
+			"zigbee": {PayloadType: config.PayloadTypeJson, Filter: "^zigbee/(?P<Ldevice>[^/]+)$", Values: map[string]string{"temp": "$.t"}, Subscriptions: []string{"zigbee/#"}},
+		},
+	}
+	samples := 0
+	d := newTestDecoder(t, configuration, func(sample *collector.Sample) {
+		samples++
+	})
+	deliver := func(msg *testMessage) {
+		for _, subscription := range d.Configuration().Topics {
+			if TopicMatches(subscription, msg.Topic()) {
+				d.HandleSubscription(subscription, msg)
+			}
+		}
+	}
+
+	deliver(&testMessage{topic: "zigbee/kitchen", payload: `{"t": 21}`})
+	if samples != 1 {
+		t.Fatalf("got %d samples, want 1", samples)
+	}
+	deliver(&testMessage{topic: "zigbee/kitchen", payload: `{"t": 21}`})
+	if samples != 1 {
+		t.Errorf("redelivered message not discarded, got %d samples", samples)
+	}
+}
@@ -0,0 +1,148 @@
+package decoder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default time allowed to an exec decoder to answer a request
+const execDecoderTimeout = 5 * time.Second
+
+// execRequest is a line written to the standard input of an exec decoder. The
+// payload is base64 encoded.
+type execRequest struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+// execResponse is the line an exec decoder writes to its standard output for
+// each request.
+type execResponse struct {
+	Values []Value `json:"values"`
+	Error  string  `json:"error"`
+}
+
+// ExecDecoder is a PayloadDecoder delegating the decoding to a long running
+// command. Each payload is written to the standard input of the command as a
+// JSON line {"topic": ..., "payload": <base64>} and the command answers with a
+// JSON line {"values": [{"name": ..., "labels": {...}, "value": ...}], "error": ...}.
+// The command is started on the first payload and restarted when it exits or
+// does not answer in time.
+type ExecDecoder struct {
+	command []string
+	timeout time.Duration
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan []byte
+	done      chan struct{}
+}
+
+// NewExecDecoder returns a decoder running command, allowing it timeout to
+// answer each request (5s when zero).
+func NewExecDecoder(command []string, timeout time.Duration) (*ExecDecoder, error) {
+	if len(command) == 0 {
+		return nil, errors.New("empty decoder command")
+	}
+	if timeout <= 0 {
+		timeout = execDecoderTimeout
+	}
+	return &ExecDecoder{command: command, timeout: timeout}, nil
+}
+
+// start starts the command. d.mu must be held by the caller.
+func (d *ExecDecoder) start() error {
+	cmd := exec.Command(d.command[0], d.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Infof("Started decoder %s (pid %d)", d.command[0], cmd.Process.Pid)
+
+	responses := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		defer cmd.Wait()
+		defer close(responses)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			select {
+			case responses <- append([]byte{}, scanner.Bytes()...):
+			case <-done:
+				return
+			}
+		}
+	}()
+	d.cmd, d.stdin, d.responses, d.done = cmd, stdin, responses, done
+	return nil
+}
+
+// stop kills the command, which is started again on the next payload. d.mu
+// must be held by the caller.
+func (d *ExecDecoder) stop() {
+	if d.cmd == nil {
+		return
+	}
+	close(d.done)
+	d.stdin.Close()
+	d.cmd.Process.Kill()
+	d.cmd, d.stdin, d.responses, d.done = nil, nil, nil, nil
+}
+
+// Decode implements PayloadDecoder. The requests are serialized.
+func (d *ExecDecoder) Decode(topic string, payload []byte) ([]Value, error) {
+	request, err := json.Marshal(execRequest{Topic: topic, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cmd == nil {
+		if err := d.start(); err != nil {
+			return nil, fmt.Errorf("failed to start decoder %s: %v", d.command[0], err)
+		}
+	}
+	if _, err := d.stdin.Write(append(request, '\n')); err != nil {
+		d.stop()
+		return nil, fmt.Errorf("decoder %s: %v", d.command[0], err)
+	}
+
+	select {
+	case line, ok := <-d.responses:
+		if !ok {
+			d.stop()
+			return nil, fmt.Errorf("decoder %s exited", d.command[0])
+		}
+		var response execResponse
+		if err := json.Unmarshal(line, &response); err != nil {
+			return nil, fmt.Errorf("decoder %s: invalid response: %v", d.command[0], err)
+		}
+		if response.Error != "" {
+			return response.Values, errors.New(response.Error)
+		}
+		return response.Values, nil
+	case <-time.After(d.timeout):
+		d.stop()
+		return nil, fmt.Errorf("decoder %s did not answer within %s", d.command[0], d.timeout)
+	}
+}
@@ -0,0 +1,228 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yalp/jsonpath"
+)
+
+// Prefix of the value definitions which are expressions instead of paths
+const expressionPrefix = "="
+
+// expression computes a value from a decoded JSON payload.
+type expression func(data interface{}) (float64, error)
+
+// isExpression reports whether a value definition is an expression.
+func isExpression(definition string) bool {
+	return strings.HasPrefix(definition, expressionPrefix)
+}
+
+// compileExpressions compiles the value definitions of a filter which are
+// expressions, e.g. `= $.voltage * $.current`.
+func compileExpressions(values map[string]string) (map[string]expression, error) {
+	var expressions map[string]expression
+	for name, definition := range values {
+		if !isExpression(definition) {
+			continue
+		}
+		e, err := compileExpression(strings.TrimPrefix(definition, expressionPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression of value %s: %v", name, err)
+		}
+		if expressions == nil {
+			expressions = make(map[string]expression)
+		}
+		expressions[name] = e
+	}
+	return expressions, nil
+}
+
+// compileExpression parses an arithmetic expression of numbers and JSONPath
+// operands with the +, -, *, / operators and parentheses.
+func compileExpression(s string) (expression, error) {
+	p := &expressionParser{s: s}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+type expressionParser struct {
+	s   string
+	pos int
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// next returns the next operator or parenthesis, if any, without consuming
+// it.
+func (p *expressionParser) next() byte {
+	p.skipSpaces()
+	if p.pos < len(p.s) && strings.IndexByte("+-*/()", p.s[p.pos]) >= 0 {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *expressionParser) parseSum() (expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next(); op == '+' || op == '-'; op = p.next() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseProduct() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next(); op == '*' || op == '/'; op = p.next() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseUnary() (expression, error) {
+	if p.next() == '-' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(data interface{}) (float64, error) {
+			v, err := operand(data)
+			return -v, err
+		}, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *expressionParser) parseOperand() (expression, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	switch c := p.s[p.pos]; {
+	case c == '(':
+		p.pos++
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ')' {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '$':
+		return p.parsePath()
+	case c == '.' || c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] == '.' || p.s[p.pos] >= '0' && p.s[p.pos] <= '9' ||
+			p.s[p.pos] == 'e' || p.s[p.pos] == 'E' ||
+			(p.s[p.pos] == '-' || p.s[p.pos] == '+') && (p.s[p.pos-1] == 'e' || p.s[p.pos-1] == 'E')) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.s[start:p.pos])
+		}
+		return func(interface{}) (float64, error) { return v, nil }, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, p.pos)
+	}
+}
+
+// parsePath parses a JSONPath operand, which ends at the first space or
+// operator outside brackets: keys containing operators must use the bracket
+// notation (e.g. $["power-factor"]).
+func (p *expressionParser) parsePath() (expression, error) {
+	start := p.pos
+	depth := 0
+	var quote byte
+	for ; p.pos < len(p.s); p.pos++ {
+		c := p.s[p.pos]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '\'' || c == '"' {
+			quote = c
+		} else if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		} else if depth == 0 && strings.IndexByte(" \t+-*/()", c) >= 0 {
+			break
+		}
+	}
+	path := p.s[start:p.pos]
+	filter, err := jsonpath.Prepare(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %v", path, err)
+	}
+	return func(data interface{}) (float64, error) {
+		value, err := filter(data)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", path, err)
+		}
+		v, err := ParseValue(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v is not a number", path, value)
+		}
+		return v, nil
+	}, nil
+}
+
+func binaryExpression(op byte, left expression, right expression) expression {
+	return func(data interface{}) (float64, error) {
+		l, err := left(data)
+		if err != nil {
+			return 0, err
+		}
+		r, err := right(data)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '+':
+			return l + r, nil
+		case '-':
+			return l - r, nil
+		case '*':
+			return l * r, nil
+		}
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return l / r, nil
+	}
+}
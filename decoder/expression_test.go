@@ -0,0 +1,74 @@
+package decoder
+
+import (
+	"testing"
+)
+
+func TestCompileExpression(t *testing.T) {
+	data := map[string]interface{}{
+		"voltage":      230.0,
+		"current":      "2.5",
+		"power-factor": 0.5,
+		"zero":         0.0,
+		"state":        "open",
+	}
+	tests := []struct {
+		expression  string
+		want        float64
+		wantErr     bool // the expression does not compile
+		wantEvalErr bool
+	}{
+		{expression: "$.voltage * $.current", want: 575},
+		{expression: "$.voltage*$.current", want: 575},
+		{expression: `$.voltage * $.current * $["power-factor"]`, want: 287.5},
+		{expression: "1 + 2 * 3", want: 7},
+		{expression: "(1 + 2) * 3", want: 9},
+		{expression: "10 - 4 - 3", want: 3},
+		{expression: "12 / 3 / 2", want: 2},
+		{expression: "-$.voltage + 1", want: -229},
+		{expression: "--2", want: 2},
+		{expression: "1.5e3 / 1e-1", want: 15000},
+		{expression: " $.voltage ", want: 230},
+		{expression: "$.voltage / $.zero", wantEvalErr: true},
+		{expression: "$.missing + 1", wantEvalErr: true},
+		{expression: "$.state * 2", wantEvalErr: true},
+		{expression: "", wantErr: true},
+		{expression: "1 +", wantErr: true},
+		{expression: "(1 + 2", wantErr: true},
+		{expression: "1 + 2)", wantErr: true},
+		{expression: "1 $.voltage", wantErr: true},
+		{expression: "voltage * 2", wantErr: true},
+		{expression: "1.2.3", wantErr: true},
+	}
+	for _, tt := range tests {
+		e, err := compileExpression(tt.expression)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("compileExpression(%q) error = %v, want error %v", tt.expression, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		got, err := e(data)
+		if (err != nil) != tt.wantEvalErr {
+			t.Errorf("%q error = %v, want error %v", tt.expression, err, tt.wantEvalErr)
+			continue
+		}
+		if !tt.wantEvalErr && got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expression, got, tt.want)
+		}
+	}
+}
+
+func TestCompileExpressions(t *testing.T) {
+	expressions, err := compileExpressions(map[string]string{"power": "= $.voltage * $.current", "voltage": "$.voltage"})
+	if err != nil {
+		t.Fatalf("compileExpressions: %v", err)
+	}
+	if len(expressions) != 1 || expressions["power"] == nil {
+		t.Errorf("compileExpressions compiled %v, want only power", expressions)
+	}
+	if _, err := compileExpressions(map[string]string{"power": "= $.voltage *"}); err == nil {
+		t.Error("compileExpressions accepted an invalid expression")
+	}
+}
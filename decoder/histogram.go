@@ -0,0 +1,109 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/yalp/jsonpath"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// readNumbers reads an array of numbers from a decoded JSON payload.
+func readNumbers(data interface{}, path string) ([]float64, error) {
+	value, err := jsonpath.Read(data, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: not an array", path)
+	}
+	numbers := make([]float64, len(array))
+	for i, v := range array {
+		if numbers[i], err = ParseValue(v); err != nil {
+			return nil, fmt.Errorf("%s: %v is not a number", path, v)
+		}
+	}
+	return numbers, nil
+}
+
+// readNumber reads a number from a decoded JSON payload.
+func readNumber(data interface{}, path string) (float64, error) {
+	value, err := jsonpath.Read(data, path)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	number, err := ParseValue(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v is not a number", path, value)
+	}
+	return number, nil
+}
+
+// decodeHistogram builds a histogram from the bucket counts of a decoded JSON
+// payload. There is a count per bucket, optionally followed by the count of
+// the values above the last bound. The total count is the +Inf bucket, the
+// count path or the last bucket, and the sum is 0 without a sum path.
+func decodeHistogram(h config.Histogram, data interface{}) (*collector.Histogram, error) {
+	bounds := h.Buckets
+	if h.BucketsPath != "" {
+		var err error
+		if bounds, err = readNumbers(data, h.BucketsPath); err != nil {
+			return nil, err
+		}
+		if len(bounds) > 0 && math.IsInf(bounds[len(bounds)-1], 1) {
+			bounds = bounds[:len(bounds)-1]
+		}
+		for i := 1; i < len(bounds); i++ {
+			if !(bounds[i] > bounds[i-1]) {
+				return nil, fmt.Errorf("%s: bounds are not increasing", h.BucketsPath)
+			}
+		}
+	}
+	counts, err := readNumbers(data, h.Counts)
+	if err != nil {
+		return nil, err
+	}
+	if len(counts) != len(bounds) && len(counts) != len(bounds)+1 {
+		return nil, fmt.Errorf("%s: %d counts for %d buckets", h.Counts, len(counts), len(bounds))
+	}
+
+	histogram := &collector.Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds))}
+	var cumulative uint64
+	for i, count := range counts {
+		if count < 0 || count != math.Trunc(count) {
+			return nil, fmt.Errorf("%s: invalid count %v", h.Counts, count)
+		}
+		if h.Cumulative {
+			if uint64(count) < cumulative {
+				return nil, fmt.Errorf("%s: cumulative counts are decreasing", h.Counts)
+			}
+			cumulative = uint64(count)
+		} else {
+			cumulative += uint64(count)
+		}
+		if i < len(bounds) {
+			histogram.Counts[i] = cumulative
+		}
+	}
+	histogram.Count = cumulative
+	if h.Count != "" {
+		count, err := readNumber(data, h.Count)
+		if err != nil {
+			return nil, err
+		}
+		if count < float64(cumulative) {
+			return nil, errors.New("count lower than the bucket counts")
+		}
+		histogram.Count = uint64(count)
+	}
+	if h.Sum != "" {
+		if histogram.Sum, err = readNumber(data, h.Sum); err != nil {
+			return nil, err
+		}
+	}
+	return histogram, nil
+}
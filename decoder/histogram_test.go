@@ -0,0 +1,107 @@
+package decoder
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+func TestDecodeHistogram(t *testing.T) {
+	tests := []struct {
+		name      string
+		histogram config.Histogram
+		payload   string
+		want      *collector.Histogram
+		wantErr   bool
+	}{
+		{
+			name:      "counts per bucket",
+			histogram: config.Histogram{Buckets: []float64{10, 20}, Counts: "$.counts", Sum: "$.sum"},
+			payload:   `{"counts": [1, 2], "sum": 25}`,
+			want:      &collector.Histogram{Count: 3, Sum: 25, Bounds: []float64{10, 20}, Counts: []uint64{1, 3}},
+		},
+		{
+			name:      "values above the last bound",
+			histogram: config.Histogram{Buckets: []float64{10, 20}, Counts: "$.counts"},
+			payload:   `{"counts": [1, 2, 4]}`,
+			want:      &collector.Histogram{Count: 7, Bounds: []float64{10, 20}, Counts: []uint64{1, 3}},
+		},
+		{
+			name:      "cumulative counts",
+			histogram: config.Histogram{Buckets: []float64{10, 20}, Counts: "$.counts", Cumulative: true},
+			payload:   `{"counts": [1, 3, 7]}`,
+			want:      &collector.Histogram{Count: 7, Bounds: []float64{10, 20}, Counts: []uint64{1, 3}},
+		},
+		{
+			name:      "count path",
+			histogram: config.Histogram{Buckets: []float64{10}, Counts: "$.counts", Count: "$.count"},
+			payload:   `{"counts": [1], "count": 5}`,
+			want:      &collector.Histogram{Count: 5, Bounds: []float64{10}, Counts: []uint64{1}},
+		},
+		{
+			name:      "bounds from the payload",
+			histogram: config.Histogram{BucketsPath: "$.le", Counts: "$.counts"},
+			payload:   `{"le": [0.1, 1, "+Inf"], "counts": [2, 3, 1]}`,
+			want:      &collector.Histogram{Count: 6, Bounds: []float64{0.1, 1}, Counts: []uint64{2, 5}},
+		},
+		{
+			name:      "decreasing bounds",
+			histogram: config.Histogram{BucketsPath: "$.le", Counts: "$.counts"},
+			payload:   `{"le": [1, 0.1], "counts": [2, 3]}`,
+			wantErr:   true,
+		},
+		{
+			name:      "missing counts",
+			histogram: config.Histogram{Buckets: []float64{10, 20, 30}, Counts: "$.counts"},
+			payload:   `{"counts": [1]}`,
+			wantErr:   true,
+		},
+		{
+			name:      "decreasing cumulative counts",
+			histogram: config.Histogram{Buckets: []float64{10, 20}, Counts: "$.counts", Cumulative: true},
+			payload:   `{"counts": [3, 1]}`,
+			wantErr:   true,
+		},
+		{
+			name:      "fractional count",
+			histogram: config.Histogram{Buckets: []float64{10}, Counts: "$.counts"},
+			payload:   `{"counts": [1.5]}`,
+			wantErr:   true,
+		},
+		{
+			name:      "negative count",
+			histogram: config.Histogram{Buckets: []float64{10}, Counts: "$.counts"},
+			payload:   `{"counts": [-1]}`,
+			wantErr:   true,
+		},
+		{
+			name:      "count lower than the buckets",
+			histogram: config.Histogram{Buckets: []float64{10}, Counts: "$.counts", Count: "$.count"},
+			payload:   `{"counts": [3], "count": 2}`,
+			wantErr:   true,
+		},
+		{
+			name:      "counts not an array",
+			histogram: config.Histogram{Buckets: []float64{10}, Counts: "$.counts"},
+			payload:   `{"counts": 3}`,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		var data interface{}
+		if err := json.Unmarshal([]byte(tt.payload), &data); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := decodeHistogram(tt.histogram, data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: decodeHistogram error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decodeHistogram = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
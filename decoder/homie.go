@@ -0,0 +1,159 @@
+package decoder
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+const (
+	homieDefaultBaseTopic = "homie"
+	homieFilter           = "homie"
+	homieGroup            = "homie"
+)
+
+// Suffixes of the metric names of the usual Homie units
+var homieUnits = map[string]string{
+	"°C":  "celsius",
+	"°F":  "fahrenheit",
+	"K":   "kelvin",
+	"%":   "percent",
+	"W":   "watts",
+	"kW":  "kilowatts",
+	"Wh":  "watt_hours",
+	"kWh": "kilowatt_hours",
+	"V":   "volts",
+	"A":   "amperes",
+	"Hz":  "hertz",
+	"Pa":  "pascals",
+	"hPa": "hectopascals",
+	"lx":  "lux",
+	"m":   "meters",
+	"m³":  "cubic_meters",
+	"L":   "liters",
+	"gal": "gallons",
+	"s":   "seconds",
+	"ppm": "ppm",
+	"#":   "",
+}
+
+var homieNameEscaper = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// homieProperty is the metadata of a Homie property.
+type homieProperty struct {
+	datatype string
+	unit     string
+	format   string
+}
+
+// homieState keeps the metadata of the Homie properties, published as
+// retained messages, across configuration changes.
+type homieState struct {
+	mu         sync.Mutex
+	properties map[string]*homieProperty
+}
+
+func newHomieState() *homieState {
+	return &homieState{properties: map[string]*homieProperty{}}
+}
+
+func (h *homieState) property(key string) homieProperty {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, ok := h.properties[key]; ok {
+		return *p
+	}
+	return homieProperty{}
+}
+
+func (h *homieState) setAttribute(key string, attribute string, value string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.properties[key]
+	if !ok {
+		p = &homieProperty{}
+		h.properties[key] = p
+	}
+	switch attribute {
+	case "$datatype":
+		p.datatype = value
+	case "$unit":
+		p.unit = value
+	case "$format":
+		p.format = value
+	}
+}
+
+// homieBaseTopic returns the base topic of the Homie devices.
+func homieBaseTopic(c config.HomieConfig) string {
+	if c.BaseTopic == "" {
+		return homieDefaultBaseTopic
+	}
+	return strings.TrimSuffix(c.BaseTopic, "/")
+}
+
+// homieMetricName returns the name of the metric of a property, suffixed with
+// its unit.
+func homieMetricName(property string, unit string) string {
+	name := strings.Trim(homieNameEscaper.ReplaceAllString(property, "_"), "_")
+	suffix, ok := homieUnits[unit]
+	if !ok {
+		suffix = strings.ToLower(strings.Trim(homieNameEscaper.ReplaceAllString(unit, "_"), "_"))
+	}
+	if suffix != "" && !strings.HasSuffix(name, "_"+suffix) {
+		name += "_" + suffix
+	}
+	return name
+}
+
+// handleHomie decodes the messages of the Homie convention
+// (<base>/<device>/<node>/<property> and the metadata topics of the
+// properties) and reports whether the topic belongs to the Homie base topic.
+// The values of the integer, float, boolean and enum properties are stored,
+// enum values as their index in $format.
+func (d *Decoder) handleHomie(msg mqtt.Message) bool {
+	base := homieBaseTopic(d.configuration.Homie)
+	if !strings.HasPrefix(msg.Topic(), base+"/") {
+		return false
+	}
+	levels := strings.Split(strings.TrimPrefix(msg.Topic(), base+"/"), "/")
+	if len(levels) == 4 && strings.HasPrefix(levels[3], "$") {
+		d.homie.setAttribute(strings.Join(levels[:3], "/"), levels[3], string(msg.Payload()))
+		return true
+	}
+	if len(levels) != 3 || strings.HasPrefix(levels[1], "$") || strings.HasPrefix(levels[2], "$") {
+		// Device and node attributes, set commands
+		return true
+	}
+
+	property := d.homie.property(strings.Join(levels, "/"))
+	filter := config.Sensor{NonNumeric: config.NonNumericSkip}
+	var value interface{} = string(msg.Payload())
+	switch property.datatype {
+	case "string", "color", "datetime", "duration":
+		return true
+	case "boolean":
+		switch value {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		}
+	case "enum":
+		filter.Enum = map[string]float64{}
+		for i, value := range strings.Split(property.format, ",") {
+			filter.Enum[value] = float64(i)
+		}
+	}
+	log.Debugf("Received Homie message: %s from topic: %s", msg.Payload(), msg.Topic())
+	labels := prometheus.Labels{"device": levels[0], "node": levels[1]}
+	d.addSample(homieFilter, filter, msg.Topic(), homieGroup, homieMetricName(levels[2], property.unit), labels, value, time.Time{})
+	return true
+}
@@ -0,0 +1,83 @@
+package decoder
+
+import (
+	"fmt"
+	"plugin"
+	"sync"
+	"time"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// PayloadDecoder decodes the payloads of a custom payloadType into values.
+// Decode may be called concurrently.
+type PayloadDecoder interface {
+	Decode(topic string, payload []byte) ([]Value, error)
+}
+
+// PayloadDecoderFunc adapts a function to the PayloadDecoder interface.
+type PayloadDecoderFunc func(topic string, payload []byte) ([]Value, error)
+
+func (f PayloadDecoderFunc) Decode(topic string, payload []byte) ([]Value, error) {
+	return f(topic, payload)
+}
+
+// Value is a value decoded from a payload. The name of the filter, or the name
+// extracted from the topic, is used when Name is empty and the labels are added
+// to the labels extracted from the topic. Value is a number, a boolean or a
+// string, converted as the values of the other payload types.
+type Value struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     interface{}       `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+var (
+	payloadDecodersMu sync.RWMutex
+	payloadDecoders   = map[string]PayloadDecoder{}
+)
+
+// Register makes a decoder available to the filters as payloadType.
+func Register(payloadType string, d PayloadDecoder) error {
+	switch payloadType {
+	case "", config.PayloadTypeJson, config.PayloadTypeRaw, config.PayloadTypeCollectd:
+		return fmt.Errorf("invalid payloadType %q for a decoder", payloadType)
+	}
+	payloadDecodersMu.Lock()
+	defer payloadDecodersMu.Unlock()
+	if _, ok := payloadDecoders[payloadType]; ok {
+		return fmt.Errorf("a decoder is already registered for payloadType %q", payloadType)
+	}
+	payloadDecoders[payloadType] = d
+	config.RegisterPayloadType(payloadType)
+	return nil
+}
+
+func payloadDecoder(payloadType string) PayloadDecoder {
+	payloadDecodersMu.RLock()
+	defer payloadDecodersMu.RUnlock()
+	return payloadDecoders[payloadType]
+}
+
+// LoadPlugin opens a Go plugin exporting a Decoder variable implementing
+// PayloadDecoder and registers it as payloadType. The plugin must be built
+// with the same Go version and dependencies as the exporter.
+func LoadPlugin(payloadType string, path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	symbol, err := p.Lookup("Decoder")
+	if err != nil {
+		return err
+	}
+	switch d := symbol.(type) {
+	case PayloadDecoder:
+		return Register(payloadType, d)
+	case *PayloadDecoder:
+		return Register(payloadType, *d)
+	default:
+		return fmt.Errorf("%s: Decoder does not implement PayloadDecoder", path)
+	}
+}
@@ -0,0 +1,81 @@
+package decoder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+const (
+	payloadErrorJson      = "json"
+	payloadErrorJsonPath  = "jsonpath"
+	payloadErrorExpr      = "expression"
+	payloadErrorHistogram = "histogram"
+	payloadErrorTimestamp = "timestamp"
+	payloadErrorDecoder   = "decoder"
+
+	// Minimum interval between two payload error warnings of a filter
+	payloadErrorLogInterval = time.Minute
+)
+
+var (
+	PayloadErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_payload_errors_total",
+			Help: "Number of payloads which could not be decoded, by filter and reason.",
+		},
+		[]string{"filter", "reason"},
+	)
+
+	payloadErrorLogsMu sync.Mutex
+	payloadErrorLogs   = map[string]*payloadErrorLog{}
+)
+
+type payloadErrorLog struct {
+	last       time.Time
+	suppressed int
+}
+
+// reportPayloadError handles a decoding error of a payload according to the
+// onError policy of the filter.
+func reportPayloadError(vk string, filter config.Sensor, reason string, topic string, err error) {
+	log.Debugf("Filter %s: %s error for topic %s: %v", vk, reason, topic, err)
+	switch filter.OnError {
+	case config.OnErrorLog:
+		logPayloadError(vk, reason, topic, err)
+	case config.OnErrorCount, config.OnErrorDrop:
+		PayloadErrors.WithLabelValues(vk, reason).Inc()
+	}
+}
+
+// logPayloadError logs a warning, at most once per filter every
+// payloadErrorLogInterval, with the number of errors suppressed since the last
+// one.
+func logPayloadError(vk string, reason string, topic string, err error) {
+	payloadErrorLogsMu.Lock()
+	l, ok := payloadErrorLogs[vk]
+	if !ok {
+		l = &payloadErrorLog{}
+		payloadErrorLogs[vk] = l
+	}
+	now := time.Now()
+	if now.Sub(l.last) < payloadErrorLogInterval {
+		l.suppressed++
+		payloadErrorLogsMu.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+	payloadErrorLogsMu.Unlock()
+
+	if suppressed > 0 {
+		log.Warnf("Filter %s: %s error for topic %s: %v (%d similar errors suppressed)", vk, reason, topic, err, suppressed)
+	} else {
+		log.Warnf("Filter %s: %s error for topic %s: %v", vk, reason, topic, err)
+	}
+}
@@ -0,0 +1,122 @@
+package decoder
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// sampleAggregate accumulates the values of a sample during a rate limit
+// interval.
+type sampleAggregate struct {
+	sample *collector.Sample
+	sum    float64
+	count  int
+	end    time.Time
+}
+
+// rateLimiter implements the per topic rate limits of the filters. In discard
+// mode, the first message of each interval is kept and the others are
+// discarded. In average mode, every message is decoded and the samples are
+// averaged over the interval before being stored.
+type rateLimiter struct {
+	mu         sync.Mutex
+	next       map[string]time.Time
+	aggregates map[string]*sampleAggregate
+	output     func(sample *collector.Sample)
+}
+
+func newRateLimiter(output func(sample *collector.Sample)) *rateLimiter {
+	r := &rateLimiter{
+		next:       map[string]time.Time{},
+		aggregates: map[string]*sampleAggregate{},
+		output:     output,
+	}
+	go r.flush()
+	return r
+}
+
+func rateLimitInterval(filter config.Sensor) time.Duration {
+	return time.Duration(filter.RateLimitInterval * float64(time.Second))
+}
+
+// allow reports whether a message received on topic for the filter vk must be
+// processed. Every message is allowed by a nil rate limiter.
+func (r *rateLimiter) allow(vk string, topic string, filter config.Sensor) bool {
+	if r == nil || filter.RateLimitInterval <= 0 || filter.RateLimitMode == config.RateLimitModeAverage {
+		return true
+	}
+
+	key := vk + "\x00" + topic
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if next, ok := r.next[key]; ok && now.Before(next) {
+		return false
+	}
+	r.next[key] = now.Add(rateLimitInterval(filter))
+	return true
+}
+
+// aggregate adds a sample to the average of its interval. The average of the
+// previous interval is stored when it is over.
+func (r *rateLimiter) aggregate(sample *collector.Sample, filter config.Sensor) {
+	now := time.Now()
+	r.mu.Lock()
+	a, ok := r.aggregates[sample.Id]
+	if ok && now.Before(a.end) {
+		a.sample = sample
+		a.sum += sample.Value
+		a.count++
+		r.mu.Unlock()
+		return
+	}
+	r.aggregates[sample.Id] = &sampleAggregate{
+		sample: sample,
+		sum:    sample.Value,
+		count:  1,
+		end:    now.Add(rateLimitInterval(filter)),
+	}
+	r.mu.Unlock()
+
+	// The output may block, it is called without holding r.mu
+	if ok {
+		r.store(a)
+	}
+}
+
+// store hands the average of an aggregate over to the output.
+func (r *rateLimiter) store(a *sampleAggregate) {
+	sample := *a.sample
+	sample.Value = a.sum / float64(a.count)
+	log.Debugf("Storing average of %d samples for %s", a.count, sample.Id)
+	r.output(&sample)
+}
+
+// flush periodically stores the aggregates whose interval is over and forgets
+// the topics whose interval is over.
+func (r *rateLimiter) flush() {
+	for now := range time.Tick(time.Second) {
+		var over []*sampleAggregate
+		r.mu.Lock()
+		for k, a := range r.aggregates {
+			if !now.Before(a.end) {
+				over = append(over, a)
+				delete(r.aggregates, k)
+			}
+		}
+		for k, next := range r.next {
+			if !now.Before(next) {
+				delete(r.next, k)
+			}
+		}
+		r.mu.Unlock()
+		for _, a := range over {
+			r.store(a)
+		}
+	}
+}
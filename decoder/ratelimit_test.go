@@ -0,0 +1,34 @@
+package decoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// The averages are output without holding the lock of the rate limiter, so
+// that a blocked output does not block the other messages.
+func TestRateLimiterAverage(t *testing.T) {
+	filter := config.Sensor{RateLimitInterval: 0.05, RateLimitMode: config.RateLimitModeAverage}
+	averages := make(chan float64)
+	var r *rateLimiter
+	r = newRateLimiter(func(sample *collector.Sample) {
+		r.allow("power", "power/plug", config.Sensor{RateLimitInterval: 1})
+		averages <- sample.Value
+	})
+
+	r.aggregate(&collector.Sample{Id: "plug", Value: 10}, filter)
+	r.aggregate(&collector.Sample{Id: "plug", Value: 20}, filter)
+	time.Sleep(60 * time.Millisecond)
+	go r.aggregate(&collector.Sample{Id: "plug", Value: 30}, filter)
+	select {
+	case average := <-averages:
+		if average != 15 {
+			t.Errorf("average = %v, want 15", average)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("average not output")
+	}
+}
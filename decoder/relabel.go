@@ -0,0 +1,125 @@
+package decoder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+const metricNameLabel = "__name__"
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// relabelRule is a compiled relabeling rule.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// compileRelabelConfigs validates the relabeling rules and compiles their
+// regular expressions, anchored at both ends as in Prometheus.
+func compileRelabelConfigs(configs []config.RelabelConfig) ([]*relabelRule, error) {
+	rules := make([]*relabelRule, 0, len(configs))
+	for i, c := range configs {
+		rule := &relabelRule{
+			sourceLabels: c.SourceLabels,
+			separator:    ";",
+			targetLabel:  c.TargetLabel,
+			replacement:  "$1",
+			action:       c.Action,
+		}
+		if c.Separator != nil {
+			rule.separator = *c.Separator
+		}
+		if c.Replacement != nil {
+			rule.replacement = *c.Replacement
+		}
+		if rule.action == "" {
+			rule.action = config.RelabelActionReplace
+		}
+		expr := "(.*)"
+		if c.Regex != nil {
+			expr = *c.Regex
+		}
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: invalid regex %q: %v", i, expr, err)
+		}
+		rule.regex = regex
+
+		switch rule.action {
+		case config.RelabelActionReplace:
+			if !labelNameRegexp.MatchString(rule.targetLabel) {
+				return nil, fmt.Errorf("relabel config %d: invalid targetLabel %q", i, rule.targetLabel)
+			}
+		case config.RelabelActionKeep, config.RelabelActionDrop:
+			if len(rule.sourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel config %d: no sourceLabels defined for the %s action", i, rule.action)
+			}
+		case config.RelabelActionLabelMap, config.RelabelActionLabelDrop, config.RelabelActionLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel config %d: wrong action value %q", i, rule.action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// relabel applies the rules to the labels of a sample, the metric name being
+// the __name__ label, and reports whether the sample must be kept.
+func relabel(rules []*relabelRule, labels map[string]string) bool {
+	for _, rule := range rules {
+		values := make([]string, len(rule.sourceLabels))
+		for i, name := range rule.sourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.action {
+		case config.RelabelActionKeep:
+			if !rule.regex.MatchString(value) {
+				return false
+			}
+		case config.RelabelActionDrop:
+			if rule.regex.MatchString(value) {
+				return false
+			}
+		case config.RelabelActionReplace:
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			result := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+			if result == "" {
+				delete(labels, rule.targetLabel)
+			} else {
+				labels[rule.targetLabel] = result
+			}
+		case config.RelabelActionLabelMap:
+			mapped := map[string]string{}
+			for name, v := range labels {
+				if rule.regex.MatchString(name) {
+					if target := rule.regex.ReplaceAllString(name, rule.replacement); labelNameRegexp.MatchString(target) {
+						mapped[target] = v
+					}
+				}
+			}
+			for name, v := range mapped {
+				labels[name] = v
+			}
+		case config.RelabelActionLabelDrop, config.RelabelActionLabelKeep:
+			for name := range labels {
+				if name != metricNameLabel && rule.regex.MatchString(name) == (rule.action == config.RelabelActionLabelDrop) {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return labels[metricNameLabel] != ""
+}
@@ -0,0 +1,165 @@
+package decoder
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// Metrics renamed to the same name share their help, and renames to invalid
+// metric names are dropped.
+func TestRelabelRename(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics: []string{"#"},
+		Sensors: map[string]config.Sensor{
+			"zigbee": {PayloadType: config.PayloadTypeJson, Filter: "^zigbee/", Group: "zigbee", Values: map[string]string{"temperature": "$.t"}},
+			"shelly": {PayloadType: config.PayloadTypeJson, Filter: "^shelly/", Group: "shelly", Values: map[string]string{"temperature": "$.t"}},
+			"bad":    {PayloadType: config.PayloadTypeJson, Filter: "^bad/", Values: map[string]string{"humidity": "$.h"}},
+		},
+		RelabelConfigs: []config.RelabelConfig{
+			{SourceLabels: []string{"__name__"}, Regex: stringPtr(".*_temperature"), TargetLabel: "__name__", Replacement: stringPtr("temperature")},
+			{SourceLabels: []string{"__name__"}, Regex: stringPtr("humidity"), TargetLabel: "__name__", Replacement: stringPtr("humidity\xff")},
+		},
+	}
+	var samples []*collector.Sample
+	d := newTestDecoder(t, configuration, func(sample *collector.Sample) {
+		samples = append(samples, sample)
+	})
+	d.Handle(&testMessage{topic: "zigbee/a", payload: `{"t": 21}`})
+	d.Handle(&testMessage{topic: "shelly/b", payload: `{"t": 22}`})
+	d.Handle(&testMessage{topic: "bad/c", payload: `{"h": 50}`})
+
+	if len(samples) != 2 {
+		t.Fatalf("got %d samples, want 2", len(samples))
+	}
+	for _, sample := range samples {
+		if sample.Name != "temperature" {
+			t.Errorf("sample name = %q, want temperature", sample.Name)
+		}
+	}
+	if samples[0].Help != samples[1].Help {
+		t.Errorf("renamed samples have different helps: %q and %q", samples[0].Help, samples[1].Help)
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		configs  []config.RelabelConfig
+		labels   map[string]string
+		want     map[string]string
+		wantKeep bool
+	}{
+		{
+			name:     "replace",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"device"}, Regex: stringPtr("0x(.*)"), TargetLabel: "id", Replacement: stringPtr("dev_$1")}},
+			labels:   map[string]string{"__name__": "temperature", "device": "0x12"},
+			want:     map[string]string{"__name__": "temperature", "device": "0x12", "id": "dev_12"},
+			wantKeep: true,
+		},
+		{
+			name:     "replace without match",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"device"}, Regex: stringPtr("0x(.*)"), TargetLabel: "id"}},
+			labels:   map[string]string{"__name__": "temperature", "device": "kitchen"},
+			want:     map[string]string{"__name__": "temperature", "device": "kitchen"},
+			wantKeep: true,
+		},
+		{
+			name:     "replace with separator",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"room", "device"}, Separator: stringPtr("/"), TargetLabel: "path"}},
+			labels:   map[string]string{"__name__": "temperature", "room": "kitchen", "device": "plug"},
+			want:     map[string]string{"__name__": "temperature", "room": "kitchen", "device": "plug", "path": "kitchen/plug"},
+			wantKeep: true,
+		},
+		{
+			name:     "empty replacement removes the label",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"missing"}, TargetLabel: "device"}},
+			labels:   map[string]string{"__name__": "temperature", "device": "plug"},
+			want:     map[string]string{"__name__": "temperature"},
+			wantKeep: true,
+		},
+		{
+			name:     "keep",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"device"}, Regex: stringPtr("plug.*"), Action: config.RelabelActionKeep}},
+			labels:   map[string]string{"__name__": "temperature", "device": "kitchen"},
+			wantKeep: false,
+		},
+		{
+			name:     "drop",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: stringPtr("linkquality"), Action: config.RelabelActionDrop}},
+			labels:   map[string]string{"__name__": "linkquality"},
+			wantKeep: false,
+		},
+		{
+			name:     "anchored regex",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: stringPtr("link"), Action: config.RelabelActionDrop}},
+			labels:   map[string]string{"__name__": "linkquality"},
+			want:     map[string]string{"__name__": "linkquality"},
+			wantKeep: true,
+		},
+		{
+			name:     "labelmap",
+			configs:  []config.RelabelConfig{{Regex: stringPtr("meta_(.+)"), Action: config.RelabelActionLabelMap}},
+			labels:   map[string]string{"__name__": "temperature", "meta_room": "kitchen"},
+			want:     map[string]string{"__name__": "temperature", "meta_room": "kitchen", "room": "kitchen"},
+			wantKeep: true,
+		},
+		{
+			name:     "labeldrop",
+			configs:  []config.RelabelConfig{{Regex: stringPtr("meta_.+"), Action: config.RelabelActionLabelDrop}},
+			labels:   map[string]string{"__name__": "temperature", "meta_room": "kitchen", "device": "plug"},
+			want:     map[string]string{"__name__": "temperature", "device": "plug"},
+			wantKeep: true,
+		},
+		{
+			name:     "labelkeep keeps the metric name",
+			configs:  []config.RelabelConfig{{Regex: stringPtr("device"), Action: config.RelabelActionLabelKeep}},
+			labels:   map[string]string{"__name__": "temperature", "meta_room": "kitchen", "device": "plug"},
+			want:     map[string]string{"__name__": "temperature", "device": "plug"},
+			wantKeep: true,
+		},
+		{
+			name:     "removed metric name",
+			configs:  []config.RelabelConfig{{SourceLabels: []string{"missing"}, TargetLabel: "__name__"}},
+			labels:   map[string]string{"__name__": "temperature"},
+			wantKeep: false,
+		},
+	}
+	for _, tt := range tests {
+		rules, err := compileRelabelConfigs(tt.configs)
+		if err != nil {
+			t.Errorf("%s: compileRelabelConfigs: %v", tt.name, err)
+			continue
+		}
+		keep := relabel(rules, tt.labels)
+		if keep != tt.wantKeep {
+			t.Errorf("%s: relabel kept the sample = %v, want %v", tt.name, keep, tt.wantKeep)
+		}
+		if keep && !maps.Equal(tt.labels, tt.want) {
+			t.Errorf("%s: labels = %v, want %v", tt.name, tt.labels, tt.want)
+		}
+	}
+}
+
+func TestCompileRelabelConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.RelabelConfig
+	}{
+		{name: "invalid regex", config: config.RelabelConfig{SourceLabels: []string{"device"}, Regex: stringPtr("(")}},
+		{name: "invalid target label", config: config.RelabelConfig{SourceLabels: []string{"device"}, TargetLabel: "0device"}},
+		{name: "keep without source labels", config: config.RelabelConfig{Action: config.RelabelActionKeep}},
+		{name: "unknown action", config: config.RelabelConfig{Action: "hashmod"}},
+	}
+	for _, tt := range tests {
+		if _, err := compileRelabelConfigs([]config.RelabelConfig{tt.config}); err == nil {
+			t.Errorf("%s: compileRelabelConfigs accepted the rule", tt.name)
+		}
+	}
+}
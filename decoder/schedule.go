@@ -0,0 +1,119 @@
+package decoder
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+var (
+	windowMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	windowDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// timeWindow is a compiled active window of a filter. from and to are minutes
+// since midnight, a window whose to is not after from spanning midnight.
+type timeWindow struct {
+	months map[time.Month]bool
+	days   map[time.Weekday]bool
+	from   int
+	to     int
+}
+
+// compileTimeWindows compiles the active windows of a filter.
+func compileTimeWindows(windows []config.TimeWindow) ([]timeWindow, error) {
+	compiled := make([]timeWindow, 0, len(windows))
+	for i, w := range windows {
+		c := timeWindow{to: 24 * 60}
+		if len(w.Months) > 0 {
+			c.months = map[time.Month]bool{}
+			for _, month := range w.Months {
+				index := indexOf(windowMonths, month)
+				if index < 0 {
+					return nil, fmt.Errorf("activeWindows[%d]: invalid month %q", i, month)
+				}
+				c.months[time.Month(index+1)] = true
+			}
+		}
+		if len(w.Days) > 0 {
+			c.days = map[time.Weekday]bool{}
+			for _, day := range w.Days {
+				index := indexOf(windowDays, day)
+				if index < 0 {
+					return nil, fmt.Errorf("activeWindows[%d]: invalid day %q", i, day)
+				}
+				c.days[time.Weekday(index)] = true
+			}
+		}
+		var err error
+		if w.From != "" {
+			if c.from, err = parseTimeOfDay(w.From); err != nil {
+				return nil, fmt.Errorf("activeWindows[%d]: %v", i, err)
+			}
+		}
+		if w.To != "" {
+			if c.to, err = parseTimeOfDay(w.To); err != nil {
+				return nil, fmt.Errorf("activeWindows[%d]: %v", i, err)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// indexOf returns the index of the abbreviated name of a month or a day,
+// case insensitive, or -1.
+func indexOf(names []string, name string) int {
+	name = strings.ToLower(name)
+	for i, v := range names {
+		if strings.HasPrefix(name, v) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseTimeOfDay parses a HH:MM time and returns the minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, HH:MM expected", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Active reports whether the filter is active at t, according to its
+// activeWindows.
+func (f *Filter) Active(t time.Time) bool {
+	return activeAt(f.windows, t)
+}
+
+// activeAt reports whether a filter with the given windows is active at t,
+// filters without windows being always active. The days and months of a
+// window spanning midnight are those of its start.
+func activeAt(windows []timeWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	for _, w := range windows {
+		start := t
+		if w.to <= w.from {
+			if minutes >= w.to && minutes < w.from {
+				continue
+			}
+			if minutes < w.to {
+				start = t.AddDate(0, 0, -1)
+			}
+		} else if minutes < w.from || minutes >= w.to {
+			continue
+		}
+		if w.months != nil && !w.months[start.Month()] || w.days != nil && !w.days[start.Weekday()] {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package decoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+func TestActiveAt(t *testing.T) {
+	// 2024-01-15 is a Monday
+	at := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name    string
+		windows []config.TimeWindow
+		t       time.Time
+		want    bool
+	}{
+		{name: "no window", t: at(time.January, 15, 12, 0), want: true},
+		{name: "month", windows: []config.TimeWindow{{Months: []string{"nov", "dec", "jan"}}}, t: at(time.January, 15, 12, 0), want: true},
+		{name: "other month", windows: []config.TimeWindow{{Months: []string{"nov", "dec", "jan"}}}, t: at(time.July, 15, 12, 0), want: false},
+		{name: "full month name", windows: []config.TimeWindow{{Months: []string{"January"}}}, t: at(time.January, 15, 12, 0), want: true},
+		{name: "day", windows: []config.TimeWindow{{Days: []string{"mon", "tue"}}}, t: at(time.January, 16, 12, 0), want: true},
+		{name: "other day", windows: []config.TimeWindow{{Days: []string{"mon", "tue"}}}, t: at(time.January, 17, 12, 0), want: false},
+		{name: "from", windows: []config.TimeWindow{{From: "08:00", To: "18:30"}}, t: at(time.January, 15, 8, 0), want: true},
+		{name: "before from", windows: []config.TimeWindow{{From: "08:00", To: "18:30"}}, t: at(time.January, 15, 7, 59), want: false},
+		{name: "to excluded", windows: []config.TimeWindow{{From: "08:00", To: "18:30"}}, t: at(time.January, 15, 18, 30), want: false},
+		{name: "night before midnight", windows: []config.TimeWindow{{From: "22:00", To: "06:00"}}, t: at(time.January, 15, 23, 0), want: true},
+		{name: "night after midnight", windows: []config.TimeWindow{{From: "22:00", To: "06:00"}}, t: at(time.January, 16, 5, 0), want: true},
+		{name: "outside night", windows: []config.TimeWindow{{From: "22:00", To: "06:00"}}, t: at(time.January, 16, 12, 0), want: false},
+		// The night from Monday to Tuesday belongs to Monday
+		{name: "night of the day before", windows: []config.TimeWindow{{Days: []string{"mon"}, From: "22:00", To: "06:00"}}, t: at(time.January, 16, 5, 0), want: true},
+		{name: "night of the day", windows: []config.TimeWindow{{Days: []string{"mon"}, From: "22:00", To: "06:00"}}, t: at(time.January, 15, 5, 0), want: false},
+		{name: "night of the month before", windows: []config.TimeWindow{{Months: []string{"jan"}, From: "22:00", To: "06:00"}}, t: at(time.February, 1, 1, 0), want: true},
+		{name: "any window", windows: []config.TimeWindow{{Days: []string{"sat"}}, {From: "08:00", To: "09:00"}}, t: at(time.January, 15, 8, 30), want: true},
+	}
+	for _, tt := range tests {
+		windows, err := compileTimeWindows(tt.windows)
+		if err != nil {
+			t.Errorf("%s: compileTimeWindows: %v", tt.name, err)
+			continue
+		}
+		if got := activeAt(windows, tt.t); got != tt.want {
+			t.Errorf("%s: activeAt(%v) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestCompileTimeWindows(t *testing.T) {
+	for _, window := range []config.TimeWindow{{Months: []string{"foo"}}, {Days: []string{"xyz"}}, {From: "8h"}, {To: "25:00"}} {
+		if _, err := compileTimeWindows([]config.TimeWindow{window}); err == nil {
+			t.Errorf("compileTimeWindows accepted %+v", window)
+		}
+	}
+}
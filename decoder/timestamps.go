@@ -0,0 +1,62 @@
+package decoder
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	timestampFormatRFC3339 = "rfc3339"
+	timestampFormatUnix    = "unix"
+	timestampFormatUnixMs  = "unix_ms"
+
+	// Epoch values above this threshold are taken as milliseconds when the
+	// format is not set (year 5138 in seconds)
+	timestampMsThreshold = 1e11
+)
+
+// parseTimestamp parses the time of a payload with the timestampFormat of a
+// filter: rfc3339, unix (epoch seconds), unix_ms (epoch milliseconds) or a Go
+// time layout. Without a format, numbers are epoch seconds or milliseconds and
+// strings are either numbers or RFC3339 times.
+func parseTimestamp(value interface{}, format string) (time.Time, error) {
+	s := valueString(value)
+	switch format {
+	case "":
+		if epoch, err := strconv.ParseFloat(s, 64); err == nil {
+			if epoch > timestampMsThreshold {
+				return epochTime(epoch, time.Millisecond)
+			}
+			return epochTime(epoch, time.Second)
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case timestampFormatRFC3339:
+		return time.Parse(time.RFC3339Nano, s)
+	case timestampFormatUnix, timestampFormatUnixMs:
+		epoch, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch time %q", s)
+		}
+		if format == timestampFormatUnixMs {
+			return epochTime(epoch, time.Millisecond)
+		}
+		return epochTime(epoch, time.Second)
+	default:
+		return time.Parse(format, s)
+	}
+}
+
+// epochTime converts an epoch time in the given unit, rounded to the
+// nanosecond. The integer part is converted separately, as its product by the
+// unit may not be exact in float64 (e.g. epoch milliseconds). The times which
+// cannot be represented in nanoseconds (after year 2262) are rejected.
+func epochTime(epoch float64, unit time.Duration) (time.Time, error) {
+	whole, fraction := math.Modf(epoch)
+	limit := float64(math.MaxInt64 / int64(unit))
+	if math.IsNaN(epoch) || whole >= limit || whole <= -limit {
+		return time.Time{}, fmt.Errorf("epoch time %v out of range", epoch)
+	}
+	return time.Unix(0, int64(whole)*int64(unit)+int64(math.Round(fraction*float64(unit)))), nil
+}
@@ -0,0 +1,43 @@
+package decoder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		format  string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: 1700000000.0, want: time.Unix(1700000000, 0)},
+		{value: 1700000000.5, want: time.Unix(1700000000, 5e8)},
+		{value: 1700000000123.0, want: time.UnixMilli(1700000000123)},
+		{value: 5e10, wantErr: true},
+		{value: -5e10, wantErr: true},
+		{value: "1700000000", want: time.Unix(1700000000, 0)},
+		{value: "2023-11-14T22:13:20Z", want: time.Unix(1700000000, 0)},
+		{value: "2023-11-14T23:13:20.25+01:00", want: time.Unix(1700000000, 25e7)},
+		{value: "2023-11-14T22:13:20Z", format: timestampFormatRFC3339, want: time.Unix(1700000000, 0)},
+		{value: "1700000000", format: timestampFormatRFC3339, wantErr: true},
+		{value: 1700000000.0, format: timestampFormatUnix, want: time.Unix(1700000000, 0)},
+		{value: 1700000000.0, format: timestampFormatUnixMs, want: time.UnixMilli(1700000000)},
+		{value: "yesterday", format: timestampFormatUnix, wantErr: true},
+		{value: 1e19, format: timestampFormatUnixMs, wantErr: true},
+		{value: "NaN", format: timestampFormatUnix, wantErr: true},
+		{value: "14/11/2023 22:13:20", format: "02/01/2006 15:04:05", want: time.Unix(1700000000, 0)},
+		{value: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.value, tt.format)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimestamp(%#v, %q) error = %v, want error %v", tt.value, tt.format, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !got.Equal(tt.want) {
+			t.Errorf("parseTimestamp(%#v, %q) = %v, want %v", tt.value, tt.format, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package decoder
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// filterCanMatch reports whether a filter may match a topic received on the
+// subscription. Only filters anchored at the beginning of the topic (^) can be
+// excluded from a wildcard subscription: the filters are matched anywhere in
+// the topic, an unanchored filter such as "zigbee2mqtt/(.+)" also matches
+// "home/zigbee2mqtt/kitchen" and is always evaluated.
+func filterCanMatch(filter string, fre *regexp.Regexp, subscription string) bool {
+	// Shared subscriptions: $share/<group>/<topic>
+	if strings.HasPrefix(subscription, "$share/") {
+		parts := strings.SplitN(subscription, "/", 3)
+		if len(parts) < 3 {
+			return true
+		}
+		subscription = parts[2]
+	}
+
+	wildcard := strings.IndexAny(subscription, "+#")
+	if wildcard < 0 {
+		return fre.MatchString(subscription)
+	}
+
+	prefix, anchored := anchoredLiteralPrefix(filter)
+	if !anchored {
+		return true
+	}
+	subscriptionPrefix := subscription[:wildcard]
+	return strings.HasPrefix(prefix, subscriptionPrefix) || strings.HasPrefix(subscriptionPrefix, prefix)
+}
+
+// anchoredLiteralPrefix returns the literal string every topic matched by an
+// expression anchored at the beginning of the topic starts with.
+func anchoredLiteralPrefix(expr string) (string, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+
+	var prefix strings.Builder
+	for _, sub := range re.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix.WriteString(string(sub.Rune))
+	}
+	return prefix.String(), true
+}
+
+// TopicMatches reports whether a topic matches a subscription topic filter,
+// following the MQTT wildcard rules (+ for one level, # for the remaining
+// levels).
+func TopicMatches(subscription string, topic string) bool {
+	if strings.HasPrefix(subscription, "$share/") {
+		parts := strings.SplitN(subscription, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		subscription = parts[2]
+	}
+
+	filterLevels := strings.Split(subscription, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// deriveTopics computes the subscriptions needed by the filters: the literal
+// prefix of each filter, assumed to match from the beginning of the topic, is
+// converted to a wildcard subscription (e.g. "zigbee2mqtt/(?P<L1>.+)" to
+// "zigbee2mqtt/#"). Subscriptions covered by another one are omitted.
+func deriveTopics(filters []string) []string {
+	derived := map[string]bool{}
+	for _, filter := range filters {
+		prefix, anchored := anchoredLiteralPrefix(filter)
+		complete := false
+		if !anchored {
+			re, err := regexp.Compile(filter)
+			if err != nil {
+				continue
+			}
+			prefix, complete = re.LiteralPrefix()
+		}
+		if strings.ContainsAny(prefix, "+#") {
+			prefix = prefix[:strings.IndexAny(prefix, "+#")]
+			complete = false
+		}
+		if complete && prefix != "" {
+			derived[prefix] = true
+			continue
+		}
+		if i := strings.LastIndex(prefix, "/"); i >= 0 {
+			derived[prefix[:i+1]+"#"] = true
+		} else {
+			derived["#"] = true
+		}
+	}
+
+	topics := []string{}
+	for topic := range derived {
+		covered := false
+		for other := range derived {
+			if other != topic && strings.HasSuffix(other, "#") && TopicMatches(other, strings.TrimSuffix(topic, "/#")) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// mergeTopics returns the configured topics followed by the added topics not
+// already configured. The added topics are logged with their source.
+func mergeTopics(configured []string, added []string, source string) []string {
+	topics := append([]string{}, configured...)
+	for _, topic := range added {
+		if !slices.Contains(topics, topic) {
+			log.Infof("Added topic %s, %s", topic, source)
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
@@ -0,0 +1,85 @@
+package decoder
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		subscription string
+		topic        string
+		want         bool
+	}{
+		{subscription: "zigbee/kitchen", topic: "zigbee/kitchen", want: true},
+		{subscription: "zigbee/kitchen", topic: "zigbee/living", want: false},
+		{subscription: "zigbee/+", topic: "zigbee/kitchen", want: true},
+		{subscription: "zigbee/+", topic: "zigbee/kitchen/temperature", want: false},
+		{subscription: "zigbee/+", topic: "zigbee", want: false},
+		{subscription: "zigbee/+/temperature", topic: "zigbee/kitchen/temperature", want: true},
+		{subscription: "zigbee/#", topic: "zigbee/kitchen/temperature", want: true},
+		{subscription: "zigbee/#", topic: "zigbee", want: true},
+		{subscription: "zigbee/#", topic: "shelly/plug", want: false},
+		{subscription: "#", topic: "zigbee/kitchen", want: true},
+		{subscription: "$share/exporters/zigbee/+", topic: "zigbee/kitchen", want: true},
+		{subscription: "$share/exporters", topic: "exporters", want: false},
+	}
+	for _, tt := range tests {
+		if got := TopicMatches(tt.subscription, tt.topic); got != tt.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", tt.subscription, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestFilterCanMatch(t *testing.T) {
+	tests := []struct {
+		filter       string
+		subscription string
+		want         bool
+	}{
+		{filter: "^zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "zigbee2mqtt/#", want: true},
+		{filter: "^zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "shelly/#", want: false},
+		{filter: "^zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "#", want: true},
+		{filter: "^zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "zigbee2mqtt/kitchen", want: true},
+		{filter: "^zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "zigbee2mqtt/kitchen/set", want: false},
+		{filter: "^zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "$share/exporters/zigbee2mqtt/+", want: true},
+		{filter: "^zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "$share/exporters/shelly/+", want: false},
+		{filter: "^zigbee(?P<L1>.*)", subscription: "zigbee2mqtt/#", want: true},
+		{filter: "(?i)^zigbee/(.*)", subscription: "ZIGBEE/#", want: true},
+		// The unanchored filters match anywhere in the topic
+		{filter: "zigbee2mqtt/(?P<Ldevice>[^/]+)$", subscription: "shelly/#", want: true},
+		{filter: "zigbee2mqtt/(?P<L1>prise_.+)", subscription: "home/#", want: true},
+		{filter: "zigbee2mqtt/(?P<L1>prise_.+)", subscription: "home/zigbee2mqtt/prise_salon", want: true},
+		{filter: "zigbee2mqtt/(?P<L1>prise_.+)", subscription: "home/shelly/plug", want: false},
+		{filter: "^zigbee2mqtt/(?P<L1>prise_.+)", subscription: "home/#", want: false},
+	}
+	for _, tt := range tests {
+		if got := filterCanMatch(tt.filter, regexp.MustCompile(tt.filter), tt.subscription); got != tt.want {
+			t.Errorf("filterCanMatch(%q, %q) = %v, want %v", tt.filter, tt.subscription, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveTopics(t *testing.T) {
+	tests := []struct {
+		filters []string
+		want    []string
+	}{
+		{filters: []string{"^zigbee2mqtt/(?P<Ldevice>[^/]+)$"}, want: []string{"zigbee2mqtt/#"}},
+		{filters: []string{"^home/sensors/(?P<Lroom>[^/]+)/temperature$"}, want: []string{"home/sensors/#"}},
+		{filters: []string{"^shellies/plug/relay/0$"}, want: []string{"shellies/plug/relay/#"}},
+		{filters: []string{"shellies/plug/relay/0"}, want: []string{"shellies/plug/relay/0"}},
+		{filters: []string{"^zigbee2mqtt/kitchen$", "^zigbee2mqtt/(?P<Ldevice>[^/]+)$"}, want: []string{"zigbee2mqtt/#"}},
+		{filters: []string{"^zigbee2mqtt/(.*)", "^shelly/(.*)"}, want: []string{"shelly/#", "zigbee2mqtt/#"}},
+		{filters: []string{"^home/(.*)", "^home/sensors/(.*)"}, want: []string{"home/#"}},
+		{filters: []string{"^zigbee(.*)"}, want: []string{"#"}},
+		{filters: []string{"(?P<Ldevice>[^/]+)/temperature$"}, want: []string{"#"}},
+		{filters: []string{"^a+/(.*)"}, want: []string{"#"}},
+	}
+	for _, tt := range tests {
+		if got := deriveTopics(tt.filters); !slices.Equal(got, tt.want) {
+			t.Errorf("deriveTopics(%q) = %q, want %q", tt.filters, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// valueString returns the string representation of a decoded value, arrays
+// with a single entry being unwrapped as ParseValue does.
+func valueString(value interface{}) string {
+	var typeInfo = reflect.ValueOf(value).Kind()
+	if typeInfo == reflect.Array || typeInfo == reflect.Slice {
+		if values, ok := value.([]interface{}); ok && len(values) == 1 {
+			value = values[0]
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
+
+// convertValue converts a decoded value to the value of a sample. Values found
+// in the enum table of the filter are mapped, the other values are parsed and
+// the non numeric value policy of the filter applies when parsing fails. It
+// returns the value, the string to export as an info metric when not empty,
+// and whether a sample must be stored.
+func convertValue(vk string, filter config.Sensor, value interface{}) (float64, string, bool) {
+	if len(filter.Enum) > 0 {
+		if v, ok := filter.Enum[valueString(value)]; ok {
+			return v, "", true
+		}
+	}
+
+	pvalue, err := ParseValue(value)
+	if err == nil {
+		return pvalue, "", true
+	}
+	ParseErrors.WithLabelValues(vk).Inc()
+	log.Debugf("Filter %s: non numeric value %v", vk, value)
+
+	switch filter.NonNumeric {
+	case config.NonNumericSkip, config.NonNumericEnum:
+		return 0, "", false
+	case config.NonNumericInfo:
+		return 1, valueString(value), true
+	default:
+		if filter.NonNumericSentinel != nil {
+			return *filter.NonNumericSentinel, "", true
+		}
+		return -1.0, "", true
+	}
+}
+
+// checkBounds applies the bounds defined for the value name, or for every
+// value ("*"), of the filter. It returns the value to store and whether it must
+// be stored.
+func checkBounds(vk string, filter config.Sensor, name string, value float64) (float64, bool) {
+	bounds, ok := filter.Bounds[name]
+	if !ok {
+		if bounds, ok = filter.Bounds["*"]; !ok {
+			return value, true
+		}
+	}
+
+	invalid := math.IsNaN(value) || math.IsInf(value, 0)
+	below := bounds.Min != nil && value < *bounds.Min
+	above := bounds.Max != nil && value > *bounds.Max
+	if !invalid && !below && !above {
+		return value, true
+	}
+	OutOfRangeValues.WithLabelValues(vk).Inc()
+	log.Debugf("Filter %s: value %s out of range: %f", vk, name, value)
+
+	switch bounds.Policy {
+	case config.BoundsPolicyKeep:
+		return value, true
+	case config.BoundsPolicyClamp:
+		if math.IsNaN(value) {
+			return value, false
+		}
+		if below {
+			return *bounds.Min, true
+		}
+		if above {
+			return *bounds.Max, true
+		}
+		// Infinite value without the matching bound
+		return value, false
+	default:
+		return value, false
+	}
+}
+
+// ParseCollectd parses the values of a collectd payload (time:value[:value...]).
+func ParseCollectd(value interface{}) ([]float64, error) {
+	svalue := fmt.Sprintf("%s", value)
+	if strings.HasSuffix(svalue, "\x00") {
+		svalue = svalue[:len(svalue)-1]
+	}
+
+	vals := []float64{}
+	var partsMessage = strings.Split(svalue, ":")
+	if len(partsMessage) > 1 {
+
+		for i, part := range partsMessage {
+			if i > 0 {
+				val, err := strconv.ParseFloat(part, 64)
+				log.Debugf("parseValue %d/%d: %s - %s", i, len(partsMessage)-1, svalue, err)
+				if err == nil {
+					vals = append(vals, val)
+				} else {
+					return []float64{}, errors.New(fmt.Sprintf("INVALID VALUE %s", svalue))
+				}
+			}
+		}
+	}
+	return vals, nil
+}
+
+// ParseValue parses a decoded value as a number. Numbers are returned as is,
+// booleans and the true/false and ON/OFF strings are mapped to 1 and 0, the
+// first entry of an array is used and the value of a time:value string is
+// parsed.
+func ParseValue(value interface{}) (float64, error) {
+	// Handles the case where the value is an array with one single entry
+	if values, ok := value.([]interface{}); ok && len(values) > 0 {
+		value = values[0]
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	svalue := fmt.Sprintf("%s", value)
+	if partsMessage := strings.Split(svalue, ":"); len(partsMessage) > 1 {
+		svalue = partsMessage[1]
+	}
+	switch svalue {
+	case "false", "OFF":
+		return 0, nil
+	case "true", "ON":
+		return 1, nil
+	}
+	val, err := strconv.ParseFloat(svalue, 64)
+	log.Debugf("parseValue: %s - %s", svalue, err)
+	if err != nil {
+		return -1.0, errors.New("INVALID VALUE")
+	}
+	return val, nil
+}
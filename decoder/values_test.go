@@ -0,0 +1,104 @@
+package decoder
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		want    float64
+		wantErr bool
+	}{
+		{value: 21.5, want: 21.5},
+		{value: 1e-7, want: 1e-7},
+		{value: 123456789.123456789, want: 123456789.123456789},
+		{value: true, want: 1},
+		{value: false, want: 0},
+		{value: "ON", want: 1},
+		{value: "OFF", want: 0},
+		{value: "true", want: 1},
+		{value: "false", want: 0},
+		{value: "42.25", want: 42.25},
+		{value: "1700000000:12.5", want: 12.5},
+		{value: []interface{}{3.0}, want: 3},
+		{value: "open", want: -1, wantErr: true},
+		{value: "", want: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseValue(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseValue(%#v) error = %v, want error %v", tt.value, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseValue(%#v) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	sentinel := -2.0
+	tests := []struct {
+		name      string
+		filter    config.Sensor
+		value     interface{}
+		want      float64
+		wantInfo  string
+		wantStore bool
+	}{
+		{name: "number", value: 12.0, want: 12, wantStore: true},
+		{name: "switch on", value: "ON", want: 1, wantStore: true},
+		{name: "switch off", value: "OFF", want: 0, wantStore: true},
+		{name: "enum", filter: config.Sensor{Enum: map[string]float64{"open": 2}}, value: "open", want: 2, wantStore: true},
+		{name: "default sentinel", value: "open", want: -1, wantStore: true},
+		{name: "custom sentinel", filter: config.Sensor{NonNumericSentinel: &sentinel}, value: "open", want: -2, wantStore: true},
+		{name: "skip", filter: config.Sensor{NonNumeric: config.NonNumericSkip}, value: "open", wantStore: false},
+		{name: "info", filter: config.Sensor{NonNumeric: config.NonNumericInfo}, value: "open", want: 1, wantInfo: "open", wantStore: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, info, store := convertValue("test", tt.filter, tt.value)
+			if store != tt.wantStore || store && (got != tt.want || info != tt.wantInfo) {
+				t.Errorf("convertValue(%#v) = %v, %q, %v, want %v, %q, %v", tt.value, got, info, store, tt.want, tt.wantInfo, tt.wantStore)
+			}
+		})
+	}
+}
+
+// The switch states of raw and JSON payloads are exported as 1 and 0 without
+// parse error.
+func TestSwitchStates(t *testing.T) {
+	configuration := &config.Configuration{
+		Topics: []string{"#"},
+		Sensors: map[string]config.Sensor{
+			"raw":  {PayloadType: config.PayloadTypeRaw, Filter: "^raw/", Name: "relay"},
+			"json": {PayloadType: config.PayloadTypeJson, Filter: "^json/", Values: map[string]string{"state": "$.state"}},
+		},
+	}
+	tests := []struct {
+		topic   string
+		payload string
+		metric  string
+		want    float64
+	}{
+		{topic: "raw/relay", payload: "ON", metric: "relay", want: 1},
+		{topic: "raw/relay", payload: "OFF", metric: "relay", want: 0},
+		{topic: "json/plug", payload: `{"state": "OFF"}`, metric: "state", want: 0},
+		{topic: "json/plug", payload: `{"state": "ON"}`, metric: "state", want: 1},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(ParseErrors.WithLabelValues("raw")) + testutil.ToFloat64(ParseErrors.WithLabelValues("json"))
+		values := probeSamples(t, configuration, tt.topic, tt.payload)
+		if got, ok := values[tt.metric]; !ok || got != tt.want {
+			t.Errorf("%s %s: %s = %v (found %v), want %v", tt.topic, tt.payload, tt.metric, got, ok, tt.want)
+		}
+		after := testutil.ToFloat64(ParseErrors.WithLabelValues("raw")) + testutil.ToFloat64(ParseErrors.WithLabelValues("json"))
+		if after != before {
+			t.Errorf("%s %s: parse errors counted", tt.topic, tt.payload)
+		}
+	}
+}
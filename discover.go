@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+	"github.com/sbouchex/mqtt_exporter/mqttclient"
+)
+
+var (
+	discoverNameEscaper = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+	discoverIdentifier  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// discoveredGroup gathers the observed topics sharing the same first level,
+// number of levels and payload type.
+type discoveredGroup struct {
+	levels      [][]string
+	payloadType string
+	values      map[string]string
+}
+
+// runDiscover subscribes to --discover-topic for --discover-duration and
+// prints the suggested configuration for the observed topics and payloads.
+func runDiscover() int {
+	var mu sync.Mutex
+	payloads := map[string][]byte{}
+
+	opts, err := mqttclient.NewClientOptions(exporterConfig.Mqtt, exporterConfig.Mqtt.ClientId+"_discover")
+	if err != nil {
+		log.Fatalf("Failed to configure the MQTT client: %v", err)
+	}
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to connect to MQTT broker %s: %v", exporterConfig.Mqtt.Broker, token.Error())
+	}
+	token := client.Subscribe(*discoverTopic, exporterConfig.Mqtt.Qos, func(client mqtt.Client, msg mqtt.Message) {
+		mu.Lock()
+		payloads[msg.Topic()] = msg.Payload()
+		mu.Unlock()
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", *discoverTopic, token.Error())
+	}
+	log.Infof("Observing %s for %s", *discoverTopic, *discoverDuration)
+	time.Sleep(*discoverDuration)
+	client.Disconnect(250)
+
+	mu.Lock()
+	defer mu.Unlock()
+	log.Infof("Observed %d topics", len(payloads))
+	suggestion := suggestConfiguration(payloads)
+	if len(suggestion["sensors"].(map[string]interface{})) == 0 {
+		log.Warn("No numeric payload observed")
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	encoder.Encode(suggestion)
+	return 0
+}
+
+// suggestConfiguration groups the topics and suggests a filter for each group.
+// The topic levels which differ in a group become labels, or the metric name
+// for the last level of raw payloads.
+func suggestConfiguration(payloads map[string][]byte) map[string]interface{} {
+	groups := map[string]*discoveredGroup{}
+	for topic, payload := range payloads {
+		payloadType, values := classifyPayload(payload)
+		if payloadType == "" {
+			continue
+		}
+		levels := strings.Split(topic, "/")
+		key := fmt.Sprintf("%s|%d|%s", levels[0], len(levels), payloadType)
+		group, ok := groups[key]
+		if !ok {
+			group = &discoveredGroup{payloadType: payloadType, values: map[string]string{}}
+			groups[key] = group
+		}
+		group.levels = append(group.levels, levels)
+		for name, path := range values {
+			group.values[name] = path
+		}
+	}
+
+	topics := []string{}
+	sensors := map[string]interface{}{}
+	for _, group := range groups {
+		filter, subscription, name := group.patterns()
+		sensor := map[string]interface{}{
+			"payloadType":                 group.payloadType,
+			"filter":                      filter,
+			"labelsCleanupFirstCharacter": true,
+		}
+		if group.payloadType == config.PayloadTypeJson {
+			sensor["values"] = group.values
+		} else if !strings.Contains(filter, "(?P<N>") {
+			sensor["name"] = name
+		}
+		key := discoverNameEscaper.ReplaceAllString(strings.ReplaceAll(subscription, "+", "x"), "_")
+		sensors[strings.Trim(key, "_")+"_"+group.payloadType] = sensor
+		if !slices.Contains(topics, subscription) {
+			topics = append(topics, subscription)
+		}
+	}
+	sort.Strings(topics)
+	return map[string]interface{}{"topics": topics, "sensors": sensors}
+}
+
+// patterns returns the filter, the MQTT subscription and the name of the last
+// constant level of the group.
+func (g *discoveredGroup) patterns() (string, string, string) {
+	first := g.levels[0]
+	filter := make([]string, len(first))
+	subscription := make([]string, len(first))
+	name := ""
+	labels := 0
+	for i := range first {
+		constant := true
+		for _, levels := range g.levels[1:] {
+			if levels[i] != first[i] {
+				constant = false
+				break
+			}
+		}
+		switch {
+		case constant:
+			filter[i] = regexp.QuoteMeta(first[i])
+			subscription[i] = first[i]
+			name = discoverNameEscaper.ReplaceAllString(first[i], "_")
+		case i == len(first)-1 && g.payloadType != config.PayloadTypeJson:
+			filter[i] = "(?P<N>[^/]+)"
+			subscription[i] = "+"
+		default:
+			label := "device"
+			if labels > 0 {
+				label = fmt.Sprintf("level%d", i)
+			}
+			labels++
+			filter[i] = fmt.Sprintf("(?P<L%s>[^/]+)", label)
+			subscription[i] = "+"
+		}
+	}
+	return "^" + strings.Join(filter, "/") + "$", strings.Join(subscription, "/"), name
+}
+
+// classifyPayload returns the suggested payload type and, for JSON objects,
+// the paths of their numeric and boolean values.
+func classifyPayload(payload []byte) (string, map[string]string) {
+	s := strings.TrimSpace(string(payload))
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return config.PayloadTypeRaw, nil
+	}
+	// collectd payloads start with an epoch time or N (now)
+	if parts := strings.SplitN(s, ":", 2); len(parts) == 2 {
+		epoch, err := strconv.ParseFloat(parts[0], 64)
+		if values, errValues := decoder.ParseCollectd(s); (parts[0] == "N" || err == nil && epoch > 1e9) && errValues == nil && len(values) > 0 {
+			return config.PayloadTypeCollectd, nil
+		}
+	}
+	var data map[string]interface{}
+	if json.Unmarshal(payload, &data) != nil {
+		return "", nil
+	}
+	values := map[string]string{}
+	collectJsonValues(data, "$", "", values)
+	if len(values) == 0 {
+		return "", nil
+	}
+	return config.PayloadTypeJson, values
+}
+
+// collectJsonValues adds the paths of the numeric and boolean values of an
+// object, nested objects included, named after their keys.
+func collectJsonValues(data map[string]interface{}, path string, name string, values map[string]string) {
+	for k, v := range data {
+		keyPath := fmt.Sprintf("%s[%s]", path, strconv.Quote(k))
+		if discoverIdentifier.MatchString(k) {
+			keyPath = path + "." + k
+		}
+		keyName := strings.Trim(discoverNameEscaper.ReplaceAllString(k, "_"), "_")
+		if name != "" {
+			keyName = name + "_" + keyName
+		}
+		switch value := v.(type) {
+		case float64, bool:
+			values[keyName] = keyPath
+		case map[string]interface{}:
+			collectJsonValues(value, keyPath, keyName, values)
+		}
+	}
+}
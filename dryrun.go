@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// dryRunSink prints the samples to stdout, in the exposition format followed
+// by the source topic, instead of exposing them.
+type dryRunSink struct {
+	mu sync.Mutex
+}
+
+func (s *dryRunSink) send(sample *collector.Sample, received time.Time) {
+	line := sampleLine(sample)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(os.Stdout, "%s # topic %s\n", line, sample.Topic)
+}
+
+// sampleLine formats a sample in the Prometheus exposition format.
+func sampleLine(sample *collector.Sample) string {
+	keys := make([]string, 0, len(sample.Labels))
+	for k := range sample.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(sample.Name)
+	if len(keys) > 0 {
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k)
+			b.WriteString(`="`)
+			b.WriteString(labelValueEscaper.Replace(sample.Labels[k]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(sample.Value))
+	if !sample.Timestamp.IsZero() {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(sample.Timestamp.UnixMilli(), 10))
+	}
+	return b.String()
+}
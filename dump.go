@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+)
+
+// Number of metric names listed in the state dump
+const dumpTopMetrics = 20
+
+// dumpState logs the active configuration, the compiled filters, the
+// subscriptions and a summary of the active samples.
+func dumpState() {
+	configuration := messageDecoder.Configuration()
+	filterConfiguration, _ := json.Marshal(configuration)
+	filters := messageDecoder.Filters()
+	for _, filter := range filters {
+		log.Infof("Dump: filter %s: pattern %s, payloadType %s, order %d", filter.Name, filter.Pattern, filter.Sensor.PayloadType, filter.Sensor.Order)
+	}
+	for _, topic := range configuration.Topics {
+		log.Infof("Dump: topic %s: filters %v", topic, messageDecoder.SubscriptionFilters(topic))
+	}
+	log.Infof("Dump: configuration %s", filterConfiguration)
+	log.Infof("Dump: %d active filters", len(filters))
+
+	var subscribed []string
+	connected := false
+	if mqttClient != nil {
+		subscribed = mqttClient.SubscribedTopics()
+		connected = mqttClient.IsConnectionOpen()
+	}
+	log.Infof("Dump: broker %s, connected %t, subscribed topics %v", exporterConfig.Mqtt.Broker, connected, subscribed)
+
+	now := time.Now()
+	expired := 0
+	byName := map[string]int{}
+	sampleCollector.ForEach(func(sample *collector.Sample) {
+		if now.After(sample.Expires) {
+			expired++
+			return
+		}
+		byName[sample.Name]++
+	})
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if byName[names[i]] != byName[names[j]] {
+			return byName[names[i]] > byName[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	log.Infof("Dump: %d active samples, %d expired, %d metric names, %d buffered", sampleCollector.Count()-int64(expired), expired, len(names), sampleCollector.Buffered())
+	for i, name := range names {
+		if i == dumpTopMetrics {
+			log.Infof("Dump: ... %d more metric names", len(names)-dumpTopMetrics)
+			break
+		}
+		log.Infof("Dump: metric %s: %d series", name, byName[name])
+	}
+}
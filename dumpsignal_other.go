@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// handleDumpSignal does nothing, SIGUSR1 being only available on Unix.
+func handleDumpSignal() {}
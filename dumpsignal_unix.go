@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleDumpSignal dumps the state of the exporter on SIGUSR1.
+func handleDumpSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			dumpState()
+		}
+	}()
+}
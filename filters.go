@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+)
+
+// Group and filter name of the metrics of the exporter itself in the scrape
+// parameters
+const exporterGroup = "exporter"
+
+// internalCollectors are the metrics of the exporter itself, selected with the
+// exporter group and filter name.
+var internalCollectors []prometheus.Collector
+
+// scrapeSelection is the subset of the metrics selected by the collect[] and
+// exclude[] parameters, over the metric groups, and the filter[] and
+// exclude_filter[] parameters, over the filters.
+type scrapeSelection struct {
+	collect, exclude        []string
+	filters, excludeFilters []string
+}
+
+// newScrapeSelection returns the selection of the query parameters of the
+// request, or nil when the request has none of them and selects every metric.
+func newScrapeSelection(r *http.Request) *scrapeSelection {
+	query := r.URL.Query()
+	s := &scrapeSelection{
+		collect:        query["collect[]"],
+		exclude:        query["exclude[]"],
+		filters:        query["filter[]"],
+		excludeFilters: query["exclude_filter[]"],
+	}
+	if len(s.collect) == 0 && len(s.exclude) == 0 && len(s.filters) == 0 && len(s.excludeFilters) == 0 {
+		return nil
+	}
+	return s
+}
+
+func selected(values []string, excluded []string, value string) bool {
+	return (len(values) == 0 || slices.Contains(values, value)) && !slices.Contains(excluded, value)
+}
+
+// group reports whether the selection keeps the metric group.
+func (s *scrapeSelection) group(group string) bool {
+	return selected(s.collect, s.exclude, group)
+}
+
+// filter reports whether the selection keeps the filter.
+func (s *scrapeSelection) filter(filter string) bool {
+	return selected(s.filters, s.excludeFilters, filter)
+}
+
+// sample reports whether the selection keeps the sample. The samples decoded
+// by no filter (last message timestamps, clock skews) belong to the exporter
+// group and filter.
+func (s *scrapeSelection) sample(sample *collector.Sample) bool {
+	if sample.Filter == "" {
+		return s.group(exporterGroup) && s.filter(exporterGroup)
+	}
+	return s.group(sample.Group) && s.filter(sample.Filter)
+}
+
+// poll reports whether the filter may decode metrics kept by the selection,
+// which is the case of any selected filter whose group is extracted from the
+// topic.
+func (s *scrapeSelection) poll(filter *decoder.Filter) bool {
+	if !s.filter(filter.Name) {
+		return false
+	}
+	group, ok := filter.Group()
+	return !ok || s.group(group)
+}
+
+// metricsHandler polls the devices of the filters selected by the request and
+// serves only the selected metrics, so that several jobs can scrape different
+// subsets of the metrics at different intervals.
+func metricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selection := newScrapeSelection(r)
+		if selection == nil {
+			pollDevices(nil)
+			next.ServeHTTP(w, r)
+			return
+		}
+		pollDevices(selection.poll)
+		internal := selection.group(exporterGroup) && selection.filter(exporterGroup)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(sampleCollector.Filtered(selection.sample, internal))
+		if internal {
+			registry.MustRegister(internalCollectors...)
+		}
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
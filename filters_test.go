@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+)
+
+func TestScrapeSelection(t *testing.T) {
+	zigbee := &collector.Sample{Filter: "zigbee_sensors", Group: "zigbee"}
+	power := &collector.Sample{Filter: "power_meters", Group: "power"}
+	homie := &collector.Sample{Filter: "homie", Group: "homie"}
+	lastSeen := &collector.Sample{}
+	tests := []struct {
+		query    string
+		selected []*collector.Sample
+		excluded []*collector.Sample
+	}{
+		{query: "collect[]=zigbee&collect[]=exporter", selected: []*collector.Sample{zigbee, lastSeen}, excluded: []*collector.Sample{power, homie}},
+		{query: "exclude[]=power", selected: []*collector.Sample{zigbee, homie, lastSeen}, excluded: []*collector.Sample{power}},
+		{query: "filter[]=power_meters", selected: []*collector.Sample{power}, excluded: []*collector.Sample{zigbee, homie, lastSeen}},
+		{query: "exclude[]=homie&exclude_filter[]=power_meters", selected: []*collector.Sample{zigbee, lastSeen}, excluded: []*collector.Sample{power, homie}},
+		{query: "collect[]=zigbee&filter[]=power_meters", excluded: []*collector.Sample{zigbee, power, homie, lastSeen}},
+	}
+	for _, test := range tests {
+		selection := newScrapeSelection(httptest.NewRequest("GET", "/metrics?"+test.query, nil))
+		for _, sample := range test.selected {
+			if !selection.sample(sample) {
+				t.Errorf("%s: %+v not selected", test.query, sample)
+			}
+		}
+		for _, sample := range test.excluded {
+			if selection.sample(sample) {
+				t.Errorf("%s: %+v selected", test.query, sample)
+			}
+		}
+	}
+	if newScrapeSelection(httptest.NewRequest("GET", "/metrics", nil)) != nil {
+		t.Error("a request without parameters selects a subset of the metrics")
+	}
+}
+
+func TestScrapeSelectionPoll(t *testing.T) {
+	fixed := &decoder.Filter{Name: "power_meters", Sensor: config.Sensor{Group: "power"}, Pattern: regexp.MustCompile(`^power/(?P<Lmeter>[^/]+)$`)}
+	extracted := &decoder.Filter{Name: "devices", Pattern: regexp.MustCompile(`^devices/(?P<G>[^/]+)/(?P<N>[^/]+)$`)}
+	tests := []struct {
+		query     string
+		fixed     bool
+		extracted bool
+	}{
+		{query: "collect[]=power", fixed: true, extracted: true},
+		{query: "collect[]=zigbee", fixed: false, extracted: true},
+		{query: "collect[]=zigbee&filter[]=devices", fixed: false, extracted: true},
+		{query: "exclude_filter[]=devices", fixed: true, extracted: false},
+	}
+	for _, test := range tests {
+		selection := newScrapeSelection(httptest.NewRequest("GET", "/metrics?"+test.query, nil))
+		if got := selection.poll(fixed); got != test.fixed {
+			t.Errorf("%s: polls %s = %v, want %v", test.query, fixed.Name, got, test.fixed)
+		}
+		if got := selection.poll(extracted); got != test.extracted {
+			t.Errorf("%s: polls %s = %v, want %v", test.query, extracted.Name, got, test.extracted)
+		}
+	}
+}
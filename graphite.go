@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// Characters not allowed in Graphite metric paths, tag names and tag values
+var graphiteEscaper = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "=", "_", "!", "_", "^", "_", "\n", "_")
+
+// graphiteWriter keeps a connection to the Graphite server, reopened after a
+// failed write.
+type graphiteWriter struct {
+	cfg  config.ExporterGraphiteConfig
+	conn net.Conn
+}
+
+// startGraphite adds a sink forwarding the samples to a Graphite server using
+// the plaintext protocol, with the labels converted to tags.
+func startGraphite(cfg config.ExporterGraphiteConfig) {
+	w := &graphiteWriter{cfg: cfg}
+	log.Infof("Forwarding samples to Graphite %s", cfg.Address)
+	sampleSinks = append(sampleSinks, newBatchSink("graphite", cfg.BatchSize, cfg.FlushInterval, w.write))
+}
+
+func (w *graphiteWriter) write(samples []timedSample) error {
+	body := graphiteLines(w.cfg.Prefix, samples)
+	if len(body) == 0 {
+		return nil
+	}
+	if w.conn == nil {
+		conn, err := net.DialTimeout("tcp", w.cfg.Address, w.cfg.Timeout)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(w.cfg.Timeout))
+	_, err := w.conn.Write(body)
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// graphiteLines formats the samples as "name;tag=value value timestamp" lines.
+func graphiteLines(prefix string, samples []timedSample) []byte {
+	var b bytes.Buffer
+	for _, v := range samples {
+		sample := v.sample
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		b.WriteString(graphiteEscaper.Replace(prefix + sample.Name))
+		keys := make([]string, 0, len(sample.Labels))
+		for k := range sample.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if sample.Labels[k] == "" {
+				continue
+			}
+			b.WriteByte(';')
+			b.WriteString(graphiteEscaper.Replace(k))
+			b.WriteByte('=')
+			b.WriteString(graphiteEscaper.Replace(sample.Labels[k]))
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(v.received.Unix(), 10))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// startInfluxDB adds a sink writing the samples to an InfluxDB v2 bucket using
+// the line protocol.
+func startInfluxDB(cfg config.ExporterInfluxDBConfig) {
+	writeUrl := fmt.Sprintf("%s/api/v2/write?%s", strings.TrimSuffix(cfg.Url, "/"), url.Values{
+		"org":       {cfg.Org},
+		"bucket":    {cfg.Bucket},
+		"precision": {"ns"},
+	}.Encode())
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	write := func(samples []timedSample) error {
+		body := influxLines(samples)
+		if len(body) == 0 {
+			return nil
+		}
+		return retryWithBackoff(cfg.MaxRetries, 500*time.Millisecond, 30*time.Second, func() (bool, error) {
+			req, err := http.NewRequest(http.MethodPost, writeUrl, bytes.NewReader(body))
+			if err != nil {
+				return false, err
+			}
+			req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			if cfg.Token != "" {
+				req.Header.Set("Authorization", "Token "+cfg.Token)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return true, err
+			}
+			defer resp.Body.Close()
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			if resp.StatusCode/100 == 2 {
+				return false, nil
+			}
+			retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+			return retry, fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+		})
+	}
+
+	log.Infof("Writing samples to InfluxDB %s (org %s, bucket %s)", cfg.Url, cfg.Org, cfg.Bucket)
+	sampleSinks = append(sampleSinks, newBatchSink("influxdb", cfg.BatchSize, cfg.FlushInterval, write))
+}
+
+// influxLines formats the samples in line protocol. Values InfluxDB cannot
+// store (NaN, Inf) are skipped.
+func influxLines(samples []timedSample) []byte {
+	var b bytes.Buffer
+	for _, v := range samples {
+		sample := v.sample
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		b.WriteString(influxMeasurementEscaper.Replace(sample.Name))
+		keys := make([]string, 0, len(sample.Labels))
+		for k := range sample.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if sample.Labels[k] == "" {
+				continue
+			}
+			b.WriteByte(',')
+			b.WriteString(influxTagEscaper.Replace(k))
+			b.WriteByte('=')
+			b.WriteString(influxTagEscaper.Replace(sample.Labels[k]))
+		}
+		b.WriteString(" value=")
+		b.WriteString(strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(v.received.UnixNano(), 10))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logLevelHandler returns the log level on GET and sets it on PUT, the level
+// (panic, fatal, error, warn, info, debug or trace) being the request body or
+// the level query parameter.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		value := r.URL.Query().Get("level")
+		if value == "" {
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			value = strings.TrimSpace(string(body))
+		}
+		level, err := log.ParseLevel(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if level != log.GetLevel() {
+			log.Warnf("Log level changed from %s to %s", log.GetLevel(), level)
+			log.SetLevel(level)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, log.GetLevel())
+}
@@ -1,618 +1,264 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
-	"reflect"
-	"regexp"
-	"sort"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/mcuadros/go-defaults"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
-	"github.com/yalp/jsonpath"
-
-	"github.com/spf13/pflag"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+	"github.com/sbouchex/mqtt_exporter/mqttclient"
 )
 
 const (
-	payloadTypeJson     = "json"
-	payloadTypeRaw      = "raw"
-	payloadTypeCollectd = "collectd"
-	configFileName      = "mqtt_exporter"
-	configFileExt       = "json"
-
-	matchTypeLabel = 'L'
-	matchTypeGroup = "G"
-	matchTypeName  = "N"
+	configFileName = "mqtt_exporter"
+	configFileExt  = "json"
 )
 
+// Version of the exporter, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 var (
-	lastPush = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "last_push_timestamp_seconds",
-			Help: "Unix timestamp of the last received metrics push in seconds.",
-		},
-	)
-
-	configuration = &Configuration{}
-	config        = ExporterConfiguration{}
-	collector     = &mqttCollector{}
-
-	reCache      = make(map[string]FilterCache)
-	reCacheIndex = []string{}
+	exporterConfig      = config.ExporterConfiguration{}
+	configurationLoader *config.Loader
+	sampleCollector     *collector.Collector
+	messageDecoder      *decoder.Decoder
+	mqttClient          *mqttclient.Client
+	remoteWrite         *remoteWriter
 )
 
-type FilterCache struct {
-	fre *regexp.Regexp
-}
-
-type ExporterConfig struct {
-	ListeningAddress  string `mapstructure:"listeningAddress" default:":9393"`
-	MetricsPath       string `mapstructure:"metricsPath" default:"/metrics"`
-	GoMetricsPath     string `mapstructure:"gometricsPath" default:"/gometrics"`
-	ConfigurationFile string `mapstructure:"configurationFile"`
-}
-
-type ExporterMqttConfig struct {
-	Broker   string `mapstructure:"broker" default:"tcp://127.0.0.1:1883"`
-	ClientId string `mapstructure:"clientId" default:"mqtt_exporter_client"`
-	Qos      byte   `mapstructure:"qos" default:"0"`
-}
-
-type ExporterConfiguration struct {
-	Config ExporterConfig     `mapstructure:"config"`
-	Mqtt   ExporterMqttConfig `mapstructure:"mqtt"`
-}
-
-type Entity struct {
-	Name        string `json:"group"`
-	LastUpdated string `json:"last_updated"`
-}
-
-type Sensor struct {
-	Filter                      string            `json:"filter"`
-	Labels                      []string          `json:"labels"`
-	Values                      map[string]string `json:"values"`
-	Group                       string            `json:"group"`
-	Name                        string            `json:"name"`
-	Disabled                    bool              `json:"disabled"`
-	PayloadType                 string            `json:"payloadType"`
-	Order                       int               `json:"order" default:"0"`
-	LabelsCleanupFirstCharacter bool              `json:"labelsCleanupFirstCharacter" default:"false"`
-}
-
-type Configuration struct {
-	Sensors    map[string]Sensor `json:"sensors"`
-	Prefix     string            `json:"prefix"`
-	Topics     []string          `mapstructure:"topics"`
-	PurgeDelay int64             `json:"purgeDelay"`
-}
-
-type TimeValueTypeFloat struct {
-	Time  int64   `json:"time"`
-	Value float64 `json:"value"`
-}
-
-type TimeValueTypeString struct {
-	Time  int64  `json:"time"`
-	Value string `json:"value"`
-}
-
-type TimeValueTypeStringArray struct {
-	Time  int64    `json:"time"`
-	Value []string `json:"value"`
-}
-
-type TimeValueTypeStringBool struct {
-	Time  int64 `json:"time"`
-	Value bool  `json:"value"`
-}
-
-func metricName(group string, name string) string {
-	result := configuration.Prefix
-	if group != "" {
-		result += fmt.Sprintf("%s_%s", strings.ReplaceAll(group, "-", "_"), strings.ReplaceAll(name, "-", "_"))
-		return result
-	} else {
-		result += strings.ReplaceAll(name, "-", "_")
-		return result
+// counterValue returns the current value of a counter.
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		return 0
 	}
+	return m.GetCounter().GetValue()
 }
 
-func metricHelp(group string, name string) string {
-	if group != "" {
-		return fmt.Sprintf("new mqttexporter: Name: '%s_%s'", group, name)
-	} else {
-		return fmt.Sprintf("new mqttexporter: Name: '%s'", name)
+// initExporter loads and applies the configuration and creates the sample
+// collector and the decoder.
+func initExporter() {
+	if *verboseVar {
+		log.SetLevel(log.DebugLevel)
 	}
-}
 
-func metricType(m Sensor) (prometheus.ValueType, error) {
-	return prometheus.GaugeValue, nil
-}
-
-func metricKey(group string, name string, labels prometheus.Labels) string {
-	if group != "" {
-		return fmt.Sprintf("%s-%s-%v", group, name, labels)
-	} else {
-		return fmt.Sprintf("%s-%v", name, labels)
+	if err := exporterConfig.Config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	sampleCollector = collector.New(exporterConfig.Config)
+	messageDecoder = decoder.New(pushSample)
+	messageDecoder.OnUnavailable = expireDevice
+	registerDecoders()
+
+	log.Info("Parsing Configuration file")
+	configurationLoader = config.NewLoader(exporterConfig.Config.ConfigurationFile, exporterConfig.Config.ConfigurationAuthorization)
+	newConfiguration, err := configurationLoader.Load()
+	if err != nil || newConfiguration == nil {
+		log.Fatalf("Failed to load configuration file %s: %v", exporterConfig.Config.ConfigurationFile, err)
+	}
+	if *verboseVar {
+		log.Debug(newConfiguration)
+	}
+	log.Infof("Parsing Configuration file: %d entries", len(newConfiguration.Sensors))
+	if err := messageDecoder.Apply(newConfiguration, *skipInvalidFilters); err != nil {
+		log.Fatalf("Invalid configuration file %s: %v", exporterConfig.Config.ConfigurationFile, err)
 	}
 }
 
-type newmqttSample struct {
-	Id      string
-	Name    string
-	Labels  map[string]string
-	Help    string
-	Value   float64
-	DType   string
-	Dstype  string
-	Time    float64
-	Type    prometheus.ValueType
-	Unit    string
-	Expires time.Time
-}
-
-type mqttCollector struct {
-	samples map[string]*newmqttSample
-	mu      *sync.Mutex
-	ch      chan *newmqttSample
-}
-
-func newmqttCollector() *mqttCollector {
-	c := &mqttCollector{
-		ch:      make(chan *newmqttSample, 0),
-		mu:      &sync.Mutex{},
-		samples: map[string]*newmqttSample{},
+// expireDevice expires, or zeroes, the samples of a device reported offline by
+// its availability topic.
+func expireDevice(filter string, labels map[string]string, zero bool) {
+	if zero {
+		log.Debugf("Filter %s: zeroed %d samples of %v", filter, sampleCollector.Zero(filter, labels), labels)
+		return
 	}
-	go c.processSamples()
-	return c
+	log.Debugf("Filter %s: expired %d samples of %v", filter, sampleCollector.Expire(filter, labels), labels)
 }
 
-func (c *mqttCollector) processSamples() {
-	ticker := time.NewTicker(time.Minute).C
-	for {
-		select {
-		case sample := <-c.ch:
-			c.mu.Lock()
-			c.samples[sample.Id] = sample
-			c.mu.Unlock()
-		case <-ticker:
-			// Garbage collect expired samples.
-			now := time.Now()
-			c.mu.Lock()
-			for k, sample := range c.samples {
-				if now.After(sample.Expires) {
-					delete(c.samples, k)
-				}
+// registerDecoders registers the external decoders of the custom payload
+// types.
+func registerDecoders() {
+	for _, d := range exporterConfig.Decoders {
+		var err error
+		switch {
+		case d.Plugin != "":
+			err = decoder.LoadPlugin(d.PayloadType, d.Plugin)
+		case len(d.Command) > 0:
+			var execDecoder *decoder.ExecDecoder
+			if execDecoder, err = decoder.NewExecDecoder(d.Command, d.Timeout); err == nil {
+				err = decoder.Register(d.PayloadType, execDecoder)
 			}
-			c.mu.Unlock()
+		default:
+			err = fmt.Errorf("no command or plugin defined")
 		}
+		if err != nil {
+			log.Fatalf("Failed to register decoder %s: %v", d.PayloadType, err)
+		}
+		log.Infof("Registered decoder %s", d.PayloadType)
 	}
 }
 
-func parseValueCollectd(value interface{}) ([]float64, error) {
-	svalue := fmt.Sprintf("%s", value)
-	if strings.HasSuffix(svalue, "\x00") {
-		svalue = svalue[:len(svalue)-1]
+// startOutputSinks starts the configured output sinks.
+func startOutputSinks() {
+	if exporterConfig.InfluxDB.Url != "" {
+		startInfluxDB(exporterConfig.InfluxDB)
 	}
-
-	vals := []float64{}
-	var partsMessage = strings.Split(svalue, ":")
-	if len(partsMessage) > 1 {
-
-		for i, part := range partsMessage {
-			if i > 0 {
-				val, err := strconv.ParseFloat(part, 64)
-				log.Debugf("parseValue %d/%d: %s - %s", i, len(partsMessage)-1, svalue, err)
-				if err == nil {
-					vals = append(vals, val)
-				} else {
-					return []float64{}, errors.New(fmt.Sprintf("INVALID VALUE %s", svalue))
-				}
-			}
-		}
+	if exporterConfig.Graphite.Address != "" {
+		startGraphite(exporterConfig.Graphite)
 	}
-	return vals, nil
-}
-
-func parseValue(value interface{}) (float64, error) {
-	svalue := fmt.Sprintf("%s", value)
-	var partsMessage = strings.Split(svalue, ":")
-	if len(partsMessage) > 1 {
-		svalue = partsMessage[1]
-	} else {
-		// Handles the case where the value is an array with one single entry
-		var typeInfo = reflect.ValueOf(value).Kind()
-		if typeInfo == reflect.Array || typeInfo == reflect.Slice {
-			value = value.([]interface{})[0]
-		}
-
-		if _, ok := (value.(float64)); ok {
-			svalue = fmt.Sprintf("%f", value)
+	if exporterConfig.Otlp.Endpoint != "" {
+		if err := startOtlp(exporterConfig.Otlp); err != nil {
+			log.Fatalf("Failed to start OTLP export: %v", err)
 		}
 	}
-	val, err := strconv.ParseFloat(svalue, 64)
-
-	if svalue == "false" || svalue == "OFF" {
-		return 0, err
+	if exporterConfig.StatsD.Address != "" {
+		if err := startStatsD(exporterConfig.StatsD); err != nil {
+			log.Fatalf("Failed to start StatsD forwarding: %v", err)
+		}
 	}
-	if svalue == "true" || svalue == "ON" {
-		return 1, err
+	if exporterConfig.Bridge.TopicPrefix != "" {
+		startBridge(exporterConfig.Bridge)
+		messageDecoder.OwnTopicPrefix = exporterConfig.Bridge.TopicPrefix
 	}
-	log.Debugf("parseValue: %s - %s", svalue, err)
-	if err == nil {
-		return val, err
+	if exporterConfig.RemoteWrite.Url != "" {
+		remoteWrite = newRemoteWriter(exporterConfig.RemoteWrite)
+		messageDecoder.OnBackfill = remoteWrite.backfill
 	}
-	return -1.0, errors.New("INVALID VALUE")
 }
 
-// Collect implements prometheus.Collector.
-func (c mqttCollector) Collect(ch chan<- prometheus.Metric) {
-	ch <- lastPush
-
-	c.mu.Lock()
-	samples := make([]*newmqttSample, 0, len(c.samples))
-	for _, sample := range c.samples {
-		samples = append(samples, sample)
+func startExporter() {
+	initExporter()
+	if *dryRun {
+		log.Info("Dry run: printing the samples instead of exposing and forwarding them")
+		sampleSinks = append(sampleSinks, &dryRunSink{})
+	} else {
+		startOutputSinks()
 	}
-	c.mu.Unlock()
 
-	now := time.Now()
-	for _, sample := range samples {
-		if now.After(sample.Expires) {
-			continue
+	if !*dryRun {
+		// Exporter without gometrics
+		prometheus.MustRegister(sampleCollector)
+		internalCollectors = append(decoder.Metrics(), remoteWriteFailures, pushgatewayFailures, sinkDroppedSamples, sinkWriteFailures, pollFailures)
+		prometheus.MustRegister(internalCollectors...)
+		prometheus.Unregister(collectors.NewGoCollector())
+		prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+		// Exporter with gometrics only
+		promReg := prometheus.NewRegistry()
+		promReg.Register(collectors.NewGoCollector())
+		http.Handle(exporterConfig.Config.GoMetricsPath, promhttp.HandlerFor(promReg, promhttp.HandlerOpts{}))
+
+		if exporterConfig.Config.ListeningAddress != "" {
+			log.Info("Listening on " + exporterConfig.Config.ListeningAddress)
 		}
-		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(sample.Name, sample.Help, []string{}, sample.Labels), sample.Type, sample.Value,
-		)
-	}
-}
-
-// Describe implements prometheus.Collector.
-func (c mqttCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- lastPush.Desc()
-}
-
-func getParams(regEx *regexp.Regexp, url string) (paramsMap map[string]string) {
-
-	match := regEx.FindStringSubmatch(url)
-	if match == nil {
-		return nil
-	}
-
-	paramsMap = make(map[string]string)
-	for i, name := range regEx.SubexpNames() {
-		if i > 0 && i <= len(match) {
-			paramsMap[name] = match[i]
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "mqtt_exporter is started")
+		})
+		http.Handle(exporterConfig.Config.MetricsPath, metricsHandler(promhttp.Handler()))
+		http.HandleFunc(strings.TrimSuffix(exporterConfig.Config.MetricsPath, "/")+"/", tenantMetricsHandler)
+		if exporterConfig.Config.LogLevelEndpoint {
+			http.HandleFunc("/-/loglevel", logLevelHandler)
 		}
-	}
-	return paramsMap
-}
-
-var messagePubHandlerDefault mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Warnf("Received message from topic: %s", msg.Topic())
-}
-
-var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	var data = msg.Payload()
-	var stData = string(data[:])
-	for _, vk := range reCacheIndex {
-		v := reCache[vk]
-		log.Debugf("Matching sensor %s", vk)
-		matches := getParams(v.fre, msg.Topic())
-		if matches != nil {
-			var filter = configuration.Sensors[vk]
-
-			var err interface{}
-			var dataValue interface{}
-			if filter.PayloadType == payloadTypeRaw {
-				log.Debugf("Received Raw message: %s from topic: %s", stData, msg.Topic())
-				var name = ""
-				for kMatches, vMatches := range matches {
-					if kMatches == matchTypeName {
-						name = vMatches
-					}
-				}
-				if name == "" {
-					name = configuration.Sensors[vk].Name
-				}
-
-				dataValue = stData
-
-				var pvalue, err = parseValue(dataValue)
-
-				var group = ""
-				for kMatches, vMatches := range matches {
-					if kMatches == matchTypeGroup {
-						group = vMatches
-					}
-				}
-				if group == "" {
-					group = configuration.Sensors[vk].Group
-				}
-
-				now := time.Now()
-				lastPush.Set(float64(now.UnixNano()) / 1e9)
-				metricType, err := metricType(configuration.Sensors[vk])
-				if err == nil {
-					labels := prometheus.Labels{}
-					for kMatches, vMatches := range matches {
-						if kMatches[0] == matchTypeLabel {
-							if configuration.Sensors[vk].LabelsCleanupFirstCharacter {
-								kMatches = kMatches[1:]
-							}
-							labels[kMatches] = vMatches
-						}
-					}
-					log.Debugf("Adding metric %s", metricKey(group, name, labels))
-					collector.ch <- &newmqttSample{
-						Id:      metricKey(group, name, labels),
-						Name:    metricName(group, name),
-						Labels:  labels,
-						Help:    metricHelp(group, name),
-						Value:   pvalue,
-						Type:    metricType,
-						Expires: now.Add(time.Duration(configuration.PurgeDelay) * time.Second),
-					}
-				} else {
-					log.Error("parseValue failure: ", err)
-				}
-			}
-
-			if filter.PayloadType == payloadTypeCollectd {
-				log.Debugf("Received Raw message: %s from topic: %s", stData, msg.Topic())
-				var name = ""
-				for kMatches, vMatches := range matches {
-					if kMatches == matchTypeName {
-						name = vMatches
-					}
-				}
-				if name == "" {
-					name = configuration.Sensors[vk].Name
-				}
-
-				dataValue = stData
-
-				var pvalues, errParse = parseValueCollectd(dataValue)
-				if errParse == nil {
-					for index, pvalue := range pvalues {
-						var group = ""
-						for kMatches, vMatches := range matches {
-							if kMatches == matchTypeGroup {
-								group = vMatches
-							}
-						}
-						if group == "" {
-							group = configuration.Sensors[vk].Group
-						}
-
-						now := time.Now()
-						lastPush.Set(float64(now.UnixNano()) / 1e9)
-						metricType, err := metricType(configuration.Sensors[vk])
-						if err == nil {
-							labels := prometheus.Labels{}
-							if len(pvalues) > 1 {
-								labels["V"] = fmt.Sprintf("%d", index)
-							}
-							for kMatches, vMatches := range matches {
-								if kMatches[0] == matchTypeLabel {
-									if configuration.Sensors[vk].LabelsCleanupFirstCharacter {
-										kMatches = kMatches[1:]
-									}
-									labels[kMatches] = vMatches
-								}
-							}
-							log.Debugf("Adding metric %s", metricKey(group, name, labels))
-							collector.ch <- &newmqttSample{
-								Id:      metricKey(group, name, labels),
-								Name:    metricName(group, name),
-								Labels:  labels,
-								Help:    metricHelp(group, name),
-								Value:   pvalue,
-								Type:    metricType,
-								Expires: now.Add(time.Duration(configuration.PurgeDelay) * time.Second),
-							}
-						}
-					}
-				} else {
-					log.Error("parseValueCollectd failure: ", errParse)
-				}
-			}
-			if filter.PayloadType == payloadTypeJson {
-				log.Debugf("Received JSON message: %s from topic: %s", stData, msg.Topic())
-				err = json.Unmarshal(data, &dataValue)
-				if err == nil {
-					for vname, vpath := range filter.Values {
-						var name = ""
-						for kMatches, vMatches := range matches {
-							if kMatches == matchTypeName {
-								name = vMatches
-							}
-						}
-						if name == "" {
-							name = vname
-						}
-						var value, _ = jsonpath.Read(dataValue, vpath)
-						if value != nil {
-							log.Debugf("Matched filter %s - message: %s from topic: %s => %s - %s = %f", vk, stData, msg.Topic(), matches, name, value)
-
-							pvalue, err := parseValue(value)
-
-							var group = configuration.Sensors[vk].Group
-
-							now := time.Now()
-							lastPush.Set(float64(now.UnixNano()) / 1e9)
-							metricType, err := metricType(configuration.Sensors[vk])
-							if err == nil {
-								labels := prometheus.Labels{}
-								for kMatches, vMatches := range matches {
-									if kMatches[0] == matchTypeLabel {
-										if configuration.Sensors[vk].LabelsCleanupFirstCharacter {
-											kMatches = kMatches[1:]
-										}
-										labels[kMatches] = vMatches
-									}
-								}
-								log.Debugf("Adding metric %s", metricKey(group, name, labels))
-								collector.ch <- &newmqttSample{
-									Id:      metricKey(group, name, labels),
-									Name:    metricName(group, name),
-									Labels:  labels,
-									Help:    metricHelp(group, name),
-									Value:   pvalue,
-									Type:    metricType,
-									Expires: now.Add(time.Duration(configuration.PurgeDelay) * time.Second),
-								}
-							} else {
-								log.Error("parseValue failure: ", err)
-							}
-						}
-					}
-				}
-			}
-			log.Debug("Matched")
-			break
+		if exporterConfig.Config.ProbeEndpoint {
+			http.HandleFunc("/probe", probeHandler)
 		}
 	}
-}
-
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	log.Warnf("Connected")
-}
 
-var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-	log.Warnf("Connect lost: %v", err)
-}
-
-func startExporter() {
-
-	if *verboseVar {
-		log.SetLevel(log.DebugLevel)
+	if exporterConfig.Config.StateFile != "" && !*dryRun {
+		restoreState(exporterConfig.Config.StateFile, exporterConfig.Config.StateSaveInterval)
 	}
 
-	configurationFile, err := os.Open(config.Config.ConfigurationFile)
-	if err == nil {
-		log.Info("Parsing Configuration file")
-		byteValue, _ := io.ReadAll(configurationFile)
-		json.Unmarshal(byteValue, &configuration)
-		if *verboseVar {
-			log.Debug(configuration)
-		}
-		log.Infof("Parsing Configuration file: %d entries", len(configuration.Sensors))
-		defer configurationFile.Close()
-	} else {
-		log.Fatalf("Failed to open configuration file: %s", config.Config.ConfigurationFile)
+	mqttConfig := exporterConfig.Mqtt
+	if *dryRun {
+		// Do not take over the session of a running exporter
+		mqttConfig.ClientId += "_dryrun"
 	}
-
-	// Exporter without gometrics
-	collector = newmqttCollector()
-	prometheus.MustRegister(collector)
-	prometheus.Unregister(collectors.NewGoCollector())
-	prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
-
-	// Exporter with gometrics only
-	promReg := prometheus.NewRegistry()
-	promReg.Register(collectors.NewGoCollector())
-	http.Handle(config.Config.GoMetricsPath, promhttp.HandlerFor(promReg, promhttp.HandlerOpts{}))
-
-	log.Info("Listening on " + config.Config.ListeningAddress)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "mqtt_exporter is started")
+	var err error
+	mqttClient, err = mqttclient.New(mqttConfig, messageDecoder, func(opts *mqtt.ClientOptions) {
+		if exporterConfig.Mqtt.StatusTopic != "" && !*dryRun {
+			opts.SetWill(exporterConfig.Mqtt.StatusTopic, statusWill(), exporterConfig.Mqtt.Qos, exporterConfig.Mqtt.StatusRetain)
+		}
 	})
-	http.Handle(config.Config.MetricsPath, promhttp.Handler())
-
-	opts := mqtt.NewClientOptions()
-	opts.SetClientID(config.Mqtt.ClientId)
-	opts.AddBroker(config.Mqtt.Broker)
-	opts.SetDefaultPublishHandler(messagePubHandlerDefault)
-	opts.SetAutoReconnect(true)
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	if err != nil {
+		log.Fatalf("Failed to create the MQTT client: %v", err)
+	}
+	mqttClient.OnSubscribed = func() {
+		sdNotify("READY=1")
+	}
+	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
 
-	log.Infof("Compiling %d filters", len(configuration.Sensors))
-	var nbRunningFilters int = 0
-	for k, v := range configuration.Sensors {
-		if !v.Disabled {
-			if v.PayloadType != payloadTypeJson && v.PayloadType != payloadTypeRaw && v.PayloadType != payloadTypeCollectd {
-				log.Fatalf("Wrong PayloadType value: %s", v.PayloadType)
-			}
-			c := FilterCache{}
-			fre := regexp.MustCompile(v.Filter)
-			c.fre = fre
-			reCache[k] = c
-			reCacheIndex = append(reCacheIndex, k)
-			nbRunningFilters = nbRunningFilters + 1
-		}
+	log.Infof("Connected to MQTT broker %s", exporterConfig.Mqtt.Broker)
+	if err := mqttClient.SubscribeTopics(false); err == nil {
+		sdNotify("READY=1")
 	}
+	mqttClient.WatchCredentials(exporterConfig.Mqtt.CredentialsCheckInterval)
+	startWatchdog(mqttClient)
+	handleDumpSignal()
+	log.Info("Waiting for messages")
 
-	// Sort sensors by Order
-	for key, value := range configuration.Sensors {
-		if !value.Disabled {
-			reCacheIndex = append(reCacheIndex, key)
+	if !*dryRun {
+		if exporterConfig.Mqtt.StatusTopic != "" {
+			go publishStatus(mqttClient, exporterConfig.Mqtt)
+		}
+		if remoteWrite != nil {
+			remoteWrite.start(prometheus.DefaultGatherer)
+		}
+		if exporterConfig.Pushgateway.Url != "" {
+			startPushgateway(exporterConfig.Pushgateway, prometheus.DefaultGatherer)
 		}
 	}
-	sort.Slice(reCacheIndex, func(i, j int) bool {
-		return configuration.Sensors[reCacheIndex[i]].Order < configuration.Sensors[reCacheIndex[j]].Order
-	})
-
-	log.Infof("Started %d filters", nbRunningFilters)
 
-	log.Infof("Connected to MQTT broker %s", config.Mqtt.Broker)
-	for _, v := range configuration.Topics {
-		log.Infof("Subscribed to topic %s", v)
-		client.Subscribe(v, byte(config.Mqtt.Qos), messagePubHandler)
+	if exporterConfig.Config.ConfigurationRefreshInterval > 0 {
+		go refreshConfiguration(exporterConfig.Config.ConfigurationRefreshInterval)
 	}
-	log.Info("Waiting for messages")
 
-	http.ListenAndServe(config.Config.ListeningAddress, nil)
+	if exporterConfig.Config.ListeningAddress == "" || *dryRun {
+		log.Info("HTTP listener disabled")
+		select {}
+	}
+	http.ListenAndServe(exporterConfig.Config.ListeningAddress, nil)
 }
 
 func LoadConfig(path string) (err error) {
 
-	pflag.Parse()
-
-	viper.AddConfigPath(path)
-	viper.SetConfigName("mqtt_exporter")
-	viper.SetConfigType("json")
+	flag.Parse()
 
+	name := configFileName
 	if *ConfigFilePath != "" {
-		viper.SetConfigName(*ConfigFilePath)
+		name = *ConfigFilePath
 	}
-
-	viper.AutomaticEnv()
-
-	err = viper.ReadInConfig()
-	if err != nil {
-		return err
-	}
-	viper.BindPFlags(pflag.CommandLine)
-	defaults.SetDefaults(&config)
-	err = viper.Unmarshal(&config)
+	viper.BindPFlags(flag.CommandLine)
+	exporterConfig, err = config.Load(path, name)
 
 	return err
 }
 
 var verboseVar *bool = flag.BoolP("verbose", "v", false, "Verbose mode")
 var ConfigFilePath *string = flag.StringP("configfile", "c", "", "Config File")
+var skipInvalidFilters *bool = flag.Bool("skip-invalid-filters", false, "Skip the invalid filters with a warning instead of refusing to start")
+var replayFile *string = flag.String("replay", "", "Replay the messages of a file through the filters and report throughput")
+var replayRate *float64 = flag.Float64("replay-rate", 0, "Replay rate in messages per second (0 for unlimited)")
+var replayCount *int = flag.Int("replay-count", 1, "Number of times the replay file is played")
+var dryRun *bool = flag.Bool("dry-run", false, "Print the samples to stdout instead of exposing and forwarding them")
+var testTopic *string = flag.String("topic", "", "Topic of the message of the test command")
+var testPayloadFile *string = flag.String("payload-file", "", "File holding the payload of the test command (- for stdin)")
+var discoverTopic *string = flag.String("discover-topic", "#", "Topic subscribed by the discover command")
+var discoverDuration *time.Duration = flag.Duration("discover-duration", 30*time.Second, "Observation duration of the discover command")
 
 func main() {
 	viper.SetEnvPrefix("MQTT_EXPORTER")
@@ -622,5 +268,20 @@ func main() {
 		log.Fatal("cannot load config:", err)
 	}
 
+	if *replayFile != "" {
+		startReplay()
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "test":
+		os.Exit(runTest())
+	case "discover":
+		os.Exit(runDiscover())
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
 	startExporter()
 }
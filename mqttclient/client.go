@@ -0,0 +1,195 @@
+// Package mqttclient connects to the MQTT broker, subscribes to the topics of
+// the active configuration and hands the received messages over to a decoder.
+package mqttclient
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+)
+
+// Client is an MQTT client whose subscriptions follow the topics of the
+// configuration of its decoder.
+type Client struct {
+	mqtt.Client
+
+	// OnSubscribed is called when the topics are subscribed after a
+	// (re)connection.
+	OnSubscribed func()
+
+	qos         byte
+	decoder     *decoder.Decoder
+	credentials *credentials
+
+	mu         sync.Mutex
+	subscribed map[string]bool
+
+	waitersMu sync.Mutex
+	waiters   map[*waiter]bool
+}
+
+// waiter is a request waiting for a message on its response topic.
+type waiter struct {
+	topic    string
+	received chan struct{}
+}
+
+// New returns a client for the broker of cfg, not connected yet. configure,
+// when not nil, may change the client options (e.g. to set a will). It fails
+// when the credentials files cannot be read.
+func New(cfg config.ExporterMqttConfig, d *decoder.Decoder, configure func(opts *mqtt.ClientOptions)) (*Client, error) {
+	creds, err := newCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := creds.clientOptions(cfg.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		qos:         cfg.Qos,
+		decoder:     d,
+		credentials: creds,
+		subscribed:  make(map[string]bool),
+		waiters:     make(map[*waiter]bool),
+	}
+
+	// Receives the messages not routed to a subscription handler, e.g.
+	// messages of a persistent session delivered before the subscriptions are
+	// restored. They are matched against every filter.
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		log.Debugf("Received unrouted message from topic: %s", msg.Topic())
+		d.Handle(msg)
+		c.notify(msg.Topic())
+	})
+	opts.SetAutoReconnect(true)
+	opts.OnConnect = func(client mqtt.Client) {
+		log.Warnf("Connected")
+		// Subscriptions are lost when the broker does not resume the session
+		if err := c.SubscribeTopics(true); err == nil && c.OnSubscribed != nil {
+			c.OnSubscribed()
+		}
+	}
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		log.Warnf("Connect lost: %v", err)
+	}
+	if configure != nil {
+		configure(opts)
+	}
+	c.Client = mqtt.NewClient(opts)
+	return c, nil
+}
+
+// SubscribeTopics aligns the MQTT subscriptions with the topics of the active
+// configuration. When resubscribe is set, every topic is subscribed again. It
+// waits for the broker acknowledgements and returns the first failure, the
+// failed topics being subscribed again on the next call.
+func (c *Client) SubscribeTopics(resubscribe bool) error {
+	configured := c.decoder.Configuration().Topics
+	topics := make(map[string]bool, len(configured))
+	for _, v := range configured {
+		topics[v] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if resubscribe {
+		c.subscribed = make(map[string]bool)
+	}
+	for v := range c.subscribed {
+		if !topics[v] {
+			log.Infof("Unsubscribed from topic %s", v)
+			c.Unsubscribe(v)
+			delete(c.subscribed, v)
+		}
+	}
+	var err error
+	for v := range topics {
+		if !c.subscribed[v] {
+			token := c.Subscribe(v, c.qos, c.subscriptionHandler(v))
+			if token.Wait() && token.Error() != nil {
+				log.Errorf("Failed to subscribe to topic %s: %v", v, token.Error())
+				if err == nil {
+					err = fmt.Errorf("subscription to %s failed: %v", v, token.Error())
+				}
+				continue
+			}
+			log.Infof("Subscribed to topic %s", v)
+			c.subscribed[v] = true
+		}
+	}
+	return err
+}
+
+// SubscribedTopics returns the sorted subscribed topics.
+func (c *Client) SubscribedTopics() []string {
+	c.mu.Lock()
+	topics := make([]string, 0, len(c.subscribed))
+	for topic := range c.subscribed {
+		topics = append(topics, topic)
+	}
+	c.mu.Unlock()
+	sort.Strings(topics)
+	return topics
+}
+
+// subscriptionHandler returns the handler of a subscription, which only
+// evaluates the filters associated with the subscription.
+func (c *Client) subscriptionHandler(topic string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		c.decoder.HandleSubscription(topic, msg)
+		c.notify(msg.Topic())
+	}
+}
+
+// notify wakes up the requests waiting for a message on the topic, once the
+// message is decoded.
+func (c *Client) notify(topic string) {
+	c.waitersMu.Lock()
+	defer c.waitersMu.Unlock()
+	for w := range c.waiters {
+		if decoder.TopicMatches(w.topic, topic) {
+			select {
+			case w.received <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Request publishes a payload to a command topic and waits until a message
+// received on the response topic (a topic filter) is decoded, for devices
+// which only answer on request.
+func (c *Client) Request(topic string, payload string, responseTopic string, timeout time.Duration) error {
+	w := &waiter{topic: responseTopic, received: make(chan struct{}, 1)}
+	c.waitersMu.Lock()
+	c.waiters[w] = true
+	c.waitersMu.Unlock()
+	defer func() {
+		c.waitersMu.Lock()
+		delete(c.waiters, w)
+		c.waitersMu.Unlock()
+	}()
+
+	deadline := time.After(timeout)
+	token := c.Publish(topic, c.qos, false, payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("publication to %s timed out", topic)
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	select {
+	case <-w.received:
+		return nil
+	case <-deadline:
+		return fmt.Errorf("no response on %s within %s", responseTopic, timeout)
+	}
+}
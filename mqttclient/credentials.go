@@ -0,0 +1,240 @@
+package mqttclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// credentials holds the password, the client certificate and the CA
+// certificates of the MQTT connection, which are read again from their files
+// when they change so that short-lived credentials do not require a restart.
+type credentials struct {
+	cfg config.ExporterMqttConfig
+
+	mu          sync.RWMutex
+	password    string
+	certificate *tls.Certificate
+	rootCAs     *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+func newCredentials(cfg config.ExporterMqttConfig) (*credentials, error) {
+	if cfg.Password != "" && cfg.PasswordFile != "" {
+		return nil, errors.New("password and passwordFile are mutually exclusive")
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("certFile and keyFile must be set together")
+	}
+	c := &credentials{cfg: cfg, password: cfg.Password}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// files returns the watched files.
+func (c *credentials) files() []string {
+	var files []string
+	for _, file := range []string{c.cfg.PasswordFile, c.cfg.CertFile, c.cfg.KeyFile, c.cfg.CaFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// reload reads the credentials files again when one of them was modified and
+// reports whether they changed. The previous credentials are kept on error,
+// e.g. when the certificate was renewed but not its key yet.
+func (c *credentials) reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		if !info.ModTime().Equal(c.modTimes[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	password := c.cfg.Password
+	if c.cfg.PasswordFile != "" {
+		content, err := os.ReadFile(c.cfg.PasswordFile)
+		if err != nil {
+			return false, err
+		}
+		password = strings.TrimSpace(string(content))
+	}
+	var certificate *tls.Certificate
+	if c.cfg.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		certificate = &pair
+	}
+	var rootCAs *x509.CertPool
+	if c.cfg.CaFile != "" {
+		content, err := os.ReadFile(c.cfg.CaFile)
+		if err != nil {
+			return false, err
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(content) {
+			return false, fmt.Errorf("no certificate found in %s", c.cfg.CaFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.password = password
+	c.certificate = certificate
+	c.rootCAs = rootCAs
+	c.modTimes = modTimes
+	c.mu.Unlock()
+	return true, nil
+}
+
+// provide returns the username and the current password, on each connection.
+func (c *credentials) provide() (string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg.Username, c.password
+}
+
+// tlsConfig returns the TLS configuration of the connection, which presents
+// the current client certificate and verifies the broker certificate with the
+// current CA certificates on each connection, or nil when no TLS option is
+// set.
+func (c *credentials) tlsConfig() (*tls.Config, error) {
+	if c.cfg.CaFile == "" && c.cfg.CertFile == "" && !c.cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.cfg.InsecureSkipVerify}
+	if c.cfg.CaFile != "" && !c.cfg.InsecureSkipVerify {
+		broker, err := url.Parse(c.cfg.Broker)
+		if err != nil {
+			return nil, err
+		}
+		// The RootCAs of the configuration cannot change, the verification
+		// of the standard library is replaced by one using the current CA
+		// certificates
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			c.mu.RLock()
+			rootCAs := c.rootCAs
+			c.mu.RUnlock()
+			return verifyServer(state, rootCAs, broker.Hostname())
+		}
+	}
+	if c.cfg.CertFile != "" {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.certificate, nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyServer verifies the certificate chain presented by the server against
+// the CA certificates and the host name of the broker.
+func verifyServer(state tls.ConnectionState, rootCAs *x509.CertPool, host string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate presented by the broker")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         rootCAs,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, certificate := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(certificate)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// NewClientOptions returns the options of a dedicated client of the broker of
+// cfg, such as the probe client, using the credentials and the TLS options of
+// cfg as they are when it is called.
+func NewClientOptions(cfg config.ExporterMqttConfig, clientId string) (*mqtt.ClientOptions, error) {
+	creds, err := newCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return creds.clientOptions(clientId)
+}
+
+// clientOptions returns the options of a client of the broker authenticated
+// with the credentials.
+func (c *credentials) clientOptions(clientId string) (*mqtt.ClientOptions, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions()
+	opts.SetClientID(clientId)
+	opts.AddBroker(c.cfg.Broker)
+	if c.cfg.Username != "" {
+		opts.SetCredentialsProvider(c.provide)
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+// WatchCredentials checks the password, certificate and CA files every
+// interval and reconnects with the new credentials when they change. The
+// broker only checks the credentials when connecting, so that an open
+// connection would otherwise keep using credentials which may be revoked.
+func (c *Client) WatchCredentials(interval time.Duration) {
+	if len(c.credentials.files()) == 0 || interval <= 0 {
+		return
+	}
+	log.Infof("Checking the MQTT credentials files every %s", interval)
+	go func() {
+		// The automatic reconnection does not apply to a connection closed
+		// by the client, the connection closed by the watcher is retried
+		// until it succeeds. A lost connection is left to the automatic
+		// reconnection, which uses the new credentials.
+		disconnected := false
+		for range time.Tick(interval) {
+			changed, err := c.credentials.reload()
+			if err != nil {
+				log.Errorf("Failed to reload the MQTT credentials: %v", err)
+			} else if changed && c.IsConnectionOpen() {
+				log.Info("MQTT credentials changed, reconnecting")
+				c.Disconnect(250)
+				disconnected = true
+			} else if changed {
+				log.Info("MQTT credentials changed")
+			}
+			if disconnected {
+				if token := c.Connect(); token.Wait() && token.Error() != nil {
+					log.Errorf("Failed to reconnect to the MQTT broker: %v", token.Error())
+				} else {
+					disconnected = false
+				}
+			}
+		}
+	}()
+}
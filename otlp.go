@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+const (
+	otlpProtocolGrpc = "grpc"
+	otlpProtocolHttp = "http"
+)
+
+// otlpExporter exports the samples to an OpenTelemetry collector, over gRPC or
+// HTTP (protobuf encoding).
+type otlpExporter struct {
+	cfg        config.ExporterOtlpConfig
+	grpcClient collectormetrics.MetricsServiceClient
+	httpClient *http.Client
+}
+
+// startOtlp adds a sink exporting the samples with OTLP. The global labels
+// are exported as resource attributes.
+func startOtlp(cfg config.ExporterOtlpConfig) error {
+	e := &otlpExporter{cfg: cfg}
+	switch cfg.Protocol {
+	case otlpProtocolGrpc:
+		creds := credentials.NewTLS(&tls.Config{})
+		if cfg.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return err
+		}
+		e.grpcClient = collectormetrics.NewMetricsServiceClient(conn)
+	case otlpProtocolHttp:
+		e.httpClient = &http.Client{Timeout: cfg.Timeout}
+	default:
+		return fmt.Errorf("Wrong otlp protocol value: %s", cfg.Protocol)
+	}
+
+	log.Infof("Exporting samples with OTLP/%s to %s", cfg.Protocol, cfg.Endpoint)
+	sampleSinks = append(sampleSinks, newBatchSink("otlp", cfg.BatchSize, cfg.FlushInterval, e.write))
+	return nil
+}
+
+func (e *otlpExporter) write(samples []timedSample) error {
+	request := e.request(samples)
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+	defer cancel()
+
+	if e.grpcClient != nil {
+		for k, v := range e.cfg.Headers {
+			ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+		}
+		_, err := e.grpcClient.Export(ctx, request)
+		return err
+	}
+
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// request groups the samples by metric into an export request.
+func (e *otlpExporter) request(samples []timedSample) *collectormetrics.ExportMetricsServiceRequest {
+	globalLabels := messageDecoder.Configuration().Labels
+
+	resource := &resourcepb.Resource{
+		Attributes: []*commonpb.KeyValue{otlpAttribute("service.name", e.cfg.ServiceName)},
+	}
+	for k, v := range globalLabels {
+		resource.Attributes = append(resource.Attributes, otlpAttribute(k, v))
+	}
+
+	metrics := []*metricspb.Metric{}
+	byName := map[string]*metricspb.Metric{}
+	for _, v := range samples {
+		sample := v.sample
+		point := &metricspb.NumberDataPoint{
+			TimeUnixNano: uint64(v.received.UnixNano()),
+			Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: sample.Value},
+		}
+		for k, value := range sample.Labels {
+			if global, ok := globalLabels[k]; ok && global == value {
+				continue
+			}
+			point.Attributes = append(point.Attributes, otlpAttribute(k, value))
+		}
+
+		metric, ok := byName[sample.Name]
+		if !ok {
+			metric = &metricspb.Metric{Name: sample.Name, Description: sample.Help}
+			if sample.Type == prometheus.CounterValue {
+				metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					IsMonotonic:            true,
+				}}
+			} else {
+				metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+			}
+			byName[sample.Name] = metric
+			metrics = append(metrics, metric)
+		}
+		switch data := metric.Data.(type) {
+		case *metricspb.Metric_Sum:
+			data.Sum.DataPoints = append(data.Sum.DataPoints, point)
+		case *metricspb.Metric_Gauge:
+			data.Gauge.DataPoints = append(data.Gauge.DataPoints, point)
+		}
+	}
+
+	return &collectormetrics.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: "mqtt_exporter"},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func otlpAttribute(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
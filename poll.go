@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default time waited for the response of a polled device
+const pollDefaultTimeout = 2 * time.Second
+
+var pollFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mqtt_exporter_poll_failures_total",
+		Help: "Number of scrape-triggered requests left unanswered, by filter.",
+	},
+	[]string{"filter"},
+)
+
+// pollDevices publishes the request of every filter with a requestTopic
+// accepted by keep, or of all of them when keep is nil, and waits, in
+// parallel, for the responses to be decoded. The filters outside their active
+// windows are not polled.
+func pollDevices(keep func(filter *decoder.Filter) bool) {
+	var wg sync.WaitGroup
+	polled := false
+	now := time.Now()
+	for _, filter := range messageDecoder.Filters() {
+		sensor := filter.Sensor
+		if sensor.RequestTopic == "" || !filter.Active(now) || (keep != nil && !keep(filter)) {
+			continue
+		}
+		polled = true
+		timeout := pollDefaultTimeout
+		if sensor.RequestTimeout > 0 {
+			timeout = time.Duration(sensor.RequestTimeout * float64(time.Second))
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := mqttClient.Request(sensor.RequestTopic, sensor.RequestPayload, sensor.ResponseTopic, timeout); err != nil {
+				pollFailures.WithLabelValues(name).Inc()
+				log.Warnf("Filter %s: request to %s failed: %v", name, sensor.RequestTopic, err)
+			}
+		}(filter.Name)
+	}
+	wg.Wait()
+
+	// Let the decoded samples be stored before the scrape
+	if polled {
+		for deadline := time.Now().Add(100 * time.Millisecond); sampleCollector.Buffered() > 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
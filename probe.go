@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+	"github.com/sbouchex/mqtt_exporter/mqttclient"
+)
+
+// Default time waited for a message of the probed topic
+const probeDefaultTimeout = 5 * time.Second
+
+// probeCollector exposes the samples of a probe.
+type probeCollector []*collector.Sample
+
+// Collect implements prometheus.Collector.
+func (p probeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, sample := range p {
+		desc := prometheus.NewDesc(sample.Name, sample.Help, nil, sample.Labels)
+		metric, err := sample.Metric(desc)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			continue
+		}
+		ch <- metric
+	}
+}
+
+// Describe implements prometheus.Collector. The collector is unchecked.
+func (p probeCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// probeTimeout returns the time waited for a message: the timeout parameter,
+// bounded by maxTimeout and the scrape timeout of Prometheus.
+func probeTimeout(r *http.Request, maxTimeout time.Duration) (time.Duration, error) {
+	timeout := probeDefaultTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+	if maxTimeout > 0 && timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds > 0 {
+			// Leave some time to answer
+			scrapeTimeout := time.Duration((seconds - 0.5) * float64(time.Second))
+			if scrapeTimeout > 0 && scrapeTimeout < timeout {
+				timeout = scrapeTimeout
+			}
+		}
+	}
+	return timeout, nil
+}
+
+// readTopic connects to the broker with a dedicated client and returns the
+// first message received on the topic, usually its retained message.
+func readTopic(topic string, timeout time.Duration) (mqtt.Message, error) {
+	opts, err := mqttclient.NewClientOptions(exporterConfig.Mqtt, fmt.Sprintf("%s_probe_%x", exporterConfig.Mqtt.ClientId, time.Now().UnixNano()))
+	if err != nil {
+		return nil, err
+	}
+	opts.SetCleanSession(true)
+	opts.SetConnectTimeout(timeout)
+	client := mqtt.NewClient(opts)
+
+	deadline := time.Now().Add(timeout)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return nil, errors.New("timeout connecting to the MQTT broker")
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	defer client.Disconnect(0)
+
+	messages := make(chan mqtt.Message, 1)
+	token = client.Subscribe(topic, exporterConfig.Mqtt.Qos, func(client mqtt.Client, msg mqtt.Message) {
+		select {
+		case messages <- msg:
+		default:
+		}
+	})
+	if !token.WaitTimeout(time.Until(deadline)) {
+		return nil, fmt.Errorf("timeout subscribing to %s", topic)
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	select {
+	case msg := <-messages:
+		return msg, nil
+	case <-time.After(time.Until(deadline)):
+		return nil, fmt.Errorf("no message received on %s within %s", topic, timeout)
+	}
+}
+
+// probeHandler reads a message of the topic parameter on demand, decodes it
+// with the filter named by the module parameter (every filter by default)
+// and returns the decoded metrics, blackbox exporter style.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "topic parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if strings.ContainsAny(topic, "+#") {
+		http.Error(w, "wildcards are not supported in the topic parameter", http.StatusBadRequest)
+		return
+	}
+	timeout, err := probeTimeout(r, exporterConfig.Config.ProbeMaxTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	module := r.URL.Query().Get("module")
+	if module != "" && !slices.ContainsFunc(messageDecoder.Filters(), func(filter *decoder.Filter) bool { return filter.Name == module }) {
+		http.Error(w, fmt.Sprintf("unknown module %s", module), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	var samples []*collector.Sample
+	msg, err := readTopic(topic, timeout)
+	if err == nil {
+		samples, err = messageDecoder.Probe(msg, module)
+	}
+	if err != nil {
+		log.Warnf("Probe of %s failed: %v", topic, err)
+	} else if len(samples) == 0 {
+		log.Warnf("Probe of %s: no metric produced", topic)
+	}
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether a message was received and decoded into metrics.",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Duration of the probe in seconds.",
+	})
+	if err == nil && len(samples) > 0 {
+		probeSuccess.Set(1)
+	}
+	probeDuration.Set(time.Since(start).Seconds())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccess, probeDuration, probeCollector(samples))
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
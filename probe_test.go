@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbeTimeout(t *testing.T) {
+	tests := []struct {
+		query         string
+		scrapeTimeout string
+		want          time.Duration
+	}{
+		{query: "", want: probeDefaultTimeout},
+		{query: "timeout=10s", want: 10 * time.Second},
+		{query: "timeout=1h", want: 30 * time.Second},
+		{query: "timeout=1h", scrapeTimeout: "10", want: 9500 * time.Millisecond},
+		{query: "timeout=2s", scrapeTimeout: "10", want: 2 * time.Second},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/probe?"+test.query, nil)
+		if test.scrapeTimeout != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", test.scrapeTimeout)
+		}
+		if got, err := probeTimeout(r, 30*time.Second); err != nil || got != test.want {
+			t.Errorf("%s (scrape timeout %q): timeout = %v, %v, want %v", test.query, test.scrapeTimeout, got, err, test.want)
+		}
+	}
+	for _, query := range []string{"timeout=0s", "timeout=-1s", "timeout=5"} {
+		if _, err := probeTimeout(httptest.NewRequest("GET", "/probe?"+query, nil), 30*time.Second); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+}
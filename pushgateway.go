@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+var pushgatewayFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mqtt_exporter_pushgateway_failures_total",
+		Help: "Number of failed pushes to the Pushgateway.",
+	},
+)
+
+// startPushgateway periodically pushes the exposed metrics to a Pushgateway,
+// replacing the metrics of the previous push.
+func startPushgateway(cfg config.ExporterPushgatewayConfig, gatherer prometheus.Gatherer) {
+	pusher := push.New(cfg.Url, cfg.Job).Gatherer(withoutTimestamps(gatherer))
+	for k, v := range cfg.Grouping {
+		pusher = pusher.Grouping(k, v)
+	}
+	if cfg.Username != "" {
+		pusher = pusher.BasicAuth(cfg.Username, cfg.Password)
+	}
+
+	log.Infof("Pushing metrics to Pushgateway %s every %s", cfg.Url, cfg.Interval)
+	go func() {
+		for range time.Tick(cfg.Interval) {
+			if err := pusher.Push(); err != nil {
+				pushgatewayFailures.Inc()
+				log.Errorf("Push to Pushgateway %s failed: %v", cfg.Url, err)
+			}
+		}
+	}()
+}
+
+// withoutTimestamps returns a gatherer removing the timestamps of the metrics,
+// such as the payload timestamps of the samples, which the Pushgateway
+// rejects.
+func withoutTimestamps(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				m.TimestampMs = nil
+			}
+		}
+		return families, err
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type timestampedCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c timestampedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c timestampedCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.NewMetricWithTimestamp(time.Unix(1700000000, 0), prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 21))
+}
+
+func TestWithoutTimestamps(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(timestampedCollector{prometheus.NewDesc("temperature", "Temperature.", nil, nil)})
+
+	families, err := withoutTimestamps(registry).Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(families) != 1 || len(families[0].GetMetric()) != 1 {
+		t.Fatalf("got %v, want one metric", families)
+	}
+	m := families[0].GetMetric()[0]
+	if m.TimestampMs != nil {
+		t.Errorf("timestamp %d not removed", m.GetTimestampMs())
+	}
+	if m.GetGauge().GetValue() != 21 {
+		t.Errorf("value = %v, want 21", m.GetGauge().GetValue())
+	}
+}
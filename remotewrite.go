@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+var remoteWriteFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mqtt_exporter_remote_write_failures_total",
+		Help: "Number of remote write requests which failed after all retries.",
+	},
+)
+
+// Size of the batches of backfilled samples
+const remoteWriteBackfillBatchSize = 500
+
+// Number of backfills waiting to be pushed, the readings of the batch
+// payloads received when the queue is full are dropped
+const remoteWriteBackfillQueueSize = 100
+
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// remoteWriter periodically gathers the exposed metrics and pushes them to a
+// Prometheus remote write endpoint, along with the backfilled samples.
+type remoteWriter struct {
+	cfg       config.ExporterRemoteWriteConfig
+	client    *http.Client
+	gatherer  prometheus.Gatherer
+	backfills chan []timedSample
+}
+
+func newRemoteWriter(cfg config.ExporterRemoteWriteConfig) *remoteWriter {
+	return &remoteWriter{
+		cfg:       cfg,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		backfills: make(chan []timedSample, remoteWriteBackfillQueueSize),
+	}
+}
+
+// start pushes the metrics of gatherer every interval, and the queued
+// backfills.
+func (w *remoteWriter) start(gatherer prometheus.Gatherer) {
+	w.gatherer = gatherer
+	log.Infof("Pushing metrics to %s every %s", w.cfg.Url, w.cfg.Interval)
+	go w.run()
+}
+
+// backfill queues the samples of the older readings of batch payloads, which
+// are pushed with their own timestamps as they are not exposed. The queued
+// samples are pushed before the exposed metrics are gathered again, so that
+// they reach the endpoint before the newest reading of their batch.
+func (w *remoteWriter) backfill(samples []*collector.Sample) {
+	var batch []timedSample
+	for _, sample := range samples {
+		// The samples of the tenants with their own metrics path are not
+		// pushed, and those without timestamp are not readings of the batch
+		if sample.Timestamp.IsZero() || sample.Tenant != "" {
+			continue
+		}
+		for _, component := range sample.Components() {
+			batch = append(batch, timedSample{component, sample.Timestamp})
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	select {
+	case w.backfills <- batch:
+	default:
+		sinkDroppedSamples.WithLabelValues("remote_write_backfill").Add(float64(len(batch)))
+	}
+}
+
+func (w *remoteWriter) run() {
+	ticker := time.NewTicker(w.cfg.Interval)
+	for {
+		select {
+		case batch := <-w.backfills:
+			w.writeBackfill(batch)
+		case <-ticker.C:
+			// The backfills queued before the gathering go first, the newest
+			// readings of their batches may be gathered
+			for queued := true; queued; {
+				select {
+				case batch := <-w.backfills:
+					w.writeBackfill(batch)
+				default:
+					queued = false
+				}
+			}
+			w.push()
+		}
+	}
+}
+
+// push gathers the exposed metrics and pushes them.
+func (w *remoteWriter) push() {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		log.Errorf("Remote write: failed to gather metrics: %v", err)
+		return
+	}
+	body := snappy.Encode(nil, w.encode(families, time.Now().UnixMilli()))
+	err = retryWithBackoff(w.cfg.MaxRetries, w.cfg.MinBackoff, w.cfg.MaxBackoff, func() (bool, error) {
+		return w.send(body)
+	})
+	if err != nil {
+		remoteWriteFailures.Inc()
+		log.Errorf("Remote write to %s failed: %v", w.cfg.Url, err)
+	}
+}
+
+// writeBackfill pushes backfilled samples by batches.
+func (w *remoteWriter) writeBackfill(samples []timedSample) {
+	for len(samples) > 0 {
+		n := min(len(samples), remoteWriteBackfillBatchSize)
+		if err := w.writeSamples(samples[:n]); err != nil {
+			remoteWriteFailures.Inc()
+			log.Errorf("Remote write of %d backfilled samples to %s failed: %v", n, w.cfg.Url, err)
+		}
+		samples = samples[n:]
+	}
+}
+
+// writeSamples pushes backfilled samples with their timestamps.
+func (w *remoteWriter) writeSamples(samples []timedSample) error {
+	var b []byte
+	for _, v := range samples {
+		pairs := make([]*dto.LabelPair, 0, len(v.sample.Labels))
+		for name, value := range v.sample.Labels {
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+		b = w.appendTimeSeries(b, v.sample.Name, pairs, nil, v.sample.Value, v.received.UnixMilli())
+	}
+	body := snappy.Encode(nil, b)
+	return retryWithBackoff(w.cfg.MaxRetries, w.cfg.MinBackoff, w.cfg.MaxBackoff, func() (bool, error) {
+		return w.send(body)
+	})
+}
+
+// send posts a compressed write request and reports whether a failure can be
+// retried.
+func (w *remoteWriter) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "mqtt_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+	if w.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.cfg.BearerToken)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+}
+
+// encode converts the metric families into a remote write request
+// (prometheus.WriteRequest protobuf message).
+func (w *remoteWriter) encode(families []*dto.MetricFamily, now int64) []byte {
+	var b []byte
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...string) {
+				b = w.appendTimeSeries(b, name, m.GetLabel(), extra, value, ts)
+			}
+			name := family.GetName()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bucket := range h.GetBucket() {
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
+
+func (w *remoteWriter) appendTimeSeries(b []byte, name string, pairs []*dto.LabelPair, extra []string, value float64, ts int64) []byte {
+	labels := make([]remoteWriteLabel, 0, len(pairs)+len(extra)/2+len(w.cfg.ExternalLabels)+1)
+	labels = append(labels, remoteWriteLabel{"__name__", name})
+	for k, v := range w.cfg.ExternalLabels {
+		labels = append(labels, remoteWriteLabel{k, v})
+	}
+	for _, pair := range pairs {
+		labels = append(labels, remoteWriteLabel{pair.GetName(), pair.GetValue()})
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels = append(labels, remoteWriteLabel{extra[i], extra[i+1]})
+	}
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	var series []byte
+	for i, label := range labels {
+		// Metric labels take precedence over the external labels
+		if i+1 < len(labels) && labels[i+1].name == label.name {
+			continue
+		}
+		var l []byte
+		l = protowire.AppendTag(l, 1, protowire.BytesType)
+		l = protowire.AppendString(l, label.name)
+		l = protowire.AppendTag(l, 2, protowire.BytesType)
+		l = protowire.AppendString(l, label.value)
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, l)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, series)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// retryWithBackoff calls fn until it succeeds, reports a non retryable error or
+// maxRetries retries were made, doubling the delay between attempts.
+func retryWithBackoff(maxRetries int, minBackoff time.Duration, maxBackoff time.Duration, fn func() (bool, error)) error {
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := fn()
+		if err == nil || !retry || attempt >= maxRetries {
+			return err
+		}
+		log.Debugf("Attempt %d failed, retrying in %s: %v", attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+// decodeWriteRequest decodes a remote write request into one line per sample:
+// its labels in the order of the request, its value and its timestamp.
+func decodeWriteRequest(t *testing.T, b []byte) []string {
+	t.Helper()
+	// fields returns the fields of a message by number, in order
+	fields := func(b []byte) map[protowire.Number][][]byte {
+		values := map[protowire.Number][][]byte{}
+		for len(b) > 0 {
+			number, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = protowire.ConsumeFieldValue(number, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", number, protowire.ParseError(n))
+			}
+			values[number] = append(values[number], b[:n])
+			b = b[n:]
+		}
+		return values
+	}
+	bytesValue := func(b []byte) []byte {
+		v, _ := protowire.ConsumeBytes(b)
+		return v
+	}
+
+	var lines []string
+	for _, series := range fields(b)[1] {
+		seriesFields := fields(bytesValue(series))
+		var labels []string
+		for _, label := range seriesFields[1] {
+			labelFields := fields(bytesValue(label))
+			labels = append(labels, fmt.Sprintf("%s=%q", bytesValue(labelFields[1][0]), bytesValue(labelFields[2][0])))
+		}
+		for _, sample := range seriesFields[2] {
+			sampleFields := fields(bytesValue(sample))
+			value, _ := protowire.ConsumeFixed64(sampleFields[1][0])
+			ts, _ := protowire.ConsumeVarint(sampleFields[2][0])
+			lines = append(lines, fmt.Sprintf("{%s} %v %d", strings.Join(labels, ","), math.Float64frombits(value), ts))
+		}
+	}
+	return lines
+}
+
+func TestRemoteWriteEncode(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "temperature", Help: "Temperature."}, []string{"device", "site"})
+	gauge.WithLabelValues("kitchen", "home").Set(21.5)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "messages_total", Help: "Messages."})
+	counter.Add(3)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "Latency.", Buckets: []float64{0.1, 1}})
+	histogram.Observe(0.5)
+	registry.MustRegister(gauge, counter, histogram)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+
+	// The labels of the metrics take precedence over the external labels
+	w := &remoteWriter{cfg: config.ExporterRemoteWriteConfig{ExternalLabels: map[string]string{"site": "default", "exporter": "mqtt"}}}
+	got := decodeWriteRequest(t, w.encode(families, 1700000000000))
+	want := []string{
+		`{__name__="latency_seconds_bucket",exporter="mqtt",le="0.1",site="default"} 0 1700000000000`,
+		`{__name__="latency_seconds_bucket",exporter="mqtt",le="1",site="default"} 1 1700000000000`,
+		`{__name__="latency_seconds_bucket",exporter="mqtt",le="+Inf",site="default"} 1 1700000000000`,
+		`{__name__="latency_seconds_sum",exporter="mqtt",site="default"} 0.5 1700000000000`,
+		`{__name__="latency_seconds_count",exporter="mqtt",site="default"} 1 1700000000000`,
+		`{__name__="messages_total",exporter="mqtt",site="default"} 3 1700000000000`,
+		`{__name__="temperature",device="kitchen",exporter="mqtt",site="home"} 21.5 1700000000000`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("encode =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// The backfilled samples are pushed before the exposed metrics gathered
+// after them.
+func TestRemoteWriteBackfillOrder(t *testing.T) {
+	requests := make(chan []string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("snappy: %v", err)
+		}
+		requests <- decodeWriteRequest(t, body)
+	}))
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "power", Help: "Power."})
+	registry.MustRegister(gauge)
+	w := newRemoteWriter(config.ExporterRemoteWriteConfig{Url: server.URL, Interval: 10 * time.Millisecond, Timeout: time.Second})
+	w.backfill([]*collector.Sample{{Name: "power", Value: 1, Timestamp: time.UnixMilli(1700000000000)}})
+	gauge.Set(2)
+	w.start(registry)
+
+	want := []string{
+		`{__name__="power"} 1 1700000000000`,
+	}
+	if got := <-requests; !slices.Equal(got, want) {
+		t.Errorf("first request = %q, want %q", got, want)
+	}
+	if got := <-requests; len(got) != 1 || !strings.HasPrefix(got[0], `{__name__="power"} 2 `) {
+		t.Errorf("second request = %q, want the gathered power", got)
+	}
+}
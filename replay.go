@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+)
+
+// replayEntry is a line of a replay file. The payload is either a JSON string
+// or any other JSON value which is used as is.
+type replayEntry struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// replayMessage implements mqtt.Message for replayed messages.
+type replayMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *replayMessage) Duplicate() bool   { return false }
+func (m *replayMessage) Qos() byte         { return 0 }
+func (m *replayMessage) Retained() bool    { return false }
+func (m *replayMessage) Topic() string     { return m.topic }
+func (m *replayMessage) MessageID() uint16 { return 0 }
+func (m *replayMessage) Payload() []byte   { return m.payload }
+func (m *replayMessage) Ack()              {}
+
+// readReplayFile reads a file of JSON lines {"topic": ..., "payload": ...}.
+func readReplayFile(path string) ([]*replayMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	messages := []*replayMessage{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry replayEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		payload := []byte(entry.Payload)
+		var s string
+		if json.Unmarshal(entry.Payload, &s) == nil {
+			payload = []byte(s)
+		}
+		messages = append(messages, &replayMessage{topic: entry.Topic, payload: payload})
+	}
+	return messages, scanner.Err()
+}
+
+// startReplay drives the messages of the replay file through the filters and
+// decoders at the configured rate and reports the throughput and allocations.
+func startReplay() {
+	initExporter()
+	startOutputSinks()
+
+	messages, err := readReplayFile(*replayFile)
+	if err != nil {
+		log.Fatalf("Failed to read replay file %s: %v", *replayFile, err)
+	}
+	log.Infof("Replaying %d messages %d times", len(messages), *replayCount)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	total := 0
+	for i := 0; i < *replayCount; i++ {
+		for _, msg := range messages {
+			if *replayRate > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(total) / *replayRate * float64(time.Second)))))
+			}
+			messageDecoder.Dispatch(msg)
+			total++
+		}
+	}
+	for sampleCollector.Buffered() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	perMessage := func(v uint64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(v) / float64(total)
+	}
+	fmt.Printf("Messages:        %d\n", total)
+	fmt.Printf("Elapsed:         %s\n", elapsed)
+	fmt.Printf("Throughput:      %.1f messages/s\n", float64(total)/elapsed.Seconds())
+	fmt.Printf("Active samples:  %d\n", sampleCollector.Count())
+	fmt.Printf("Dropped samples: %.0f\n", counterValue(collector.DroppedSamples))
+	fmt.Printf("Allocations:     %d (%.1f/message)\n", after.Mallocs-before.Mallocs, perMessage(after.Mallocs-before.Mallocs))
+	fmt.Printf("Allocated bytes: %d (%.1f/message)\n", after.TotalAlloc-before.TotalAlloc, perMessage(after.TotalAlloc-before.TotalAlloc))
+	fmt.Printf("GC cycles:       %d\n", after.NumGC-before.NumGC)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+)
+
+var (
+	sinkDroppedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_sink_samples_dropped_total",
+			Help: "Number of samples dropped because the buffer of an output sink was full.",
+		},
+		[]string{"sink"},
+	)
+	sinkWriteFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_exporter_sink_write_failures_total",
+			Help: "Number of failed writes to an output sink.",
+		},
+		[]string{"sink"},
+	)
+
+	sampleSinks []sampleSink
+)
+
+// sampleSink receives every decoded sample in addition to the collector.
+// send must not block.
+type sampleSink interface {
+	send(sample *collector.Sample, received time.Time)
+}
+
+// pushSample hands a sample over to the output sinks and the collector. The
+// sinks receive the components of the histograms.
+func pushSample(sample *collector.Sample) {
+	if len(sampleSinks) > 0 {
+		received := sample.Timestamp
+		if received.IsZero() {
+			received = time.Now()
+		}
+		for _, component := range sample.Components() {
+			for _, sink := range sampleSinks {
+				sink.send(component, received)
+			}
+		}
+	}
+	sampleCollector.Push(sample)
+}
+
+type timedSample struct {
+	sample   *collector.Sample
+	received time.Time
+}
+
+// batchSink buffers the samples and writes them by batches, when the batch is
+// full or every flush interval.
+type batchSink struct {
+	name          string
+	ch            chan timedSample
+	batchSize     int
+	flushInterval time.Duration
+	write         func(samples []timedSample) error
+}
+
+func newBatchSink(name string, batchSize int, flushInterval time.Duration, write func(samples []timedSample) error) *batchSink {
+	s := &batchSink{
+		name:          name,
+		ch:            make(chan timedSample, batchSize*10),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		write:         write,
+	}
+	go s.run()
+	return s
+}
+
+func (s *batchSink) send(sample *collector.Sample, received time.Time) {
+	select {
+	case s.ch <- timedSample{sample, received}:
+	default:
+		sinkDroppedSamples.WithLabelValues(s.name).Inc()
+	}
+}
+
+func (s *batchSink) run() {
+	ticker := time.NewTicker(s.flushInterval)
+	batch := make([]timedSample, 0, s.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.write(batch); err != nil {
+			sinkWriteFailures.WithLabelValues(s.name).Inc()
+			log.Errorf("Failed to write %d samples to %s: %v", len(batch), s.name, err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case sample := <-s.ch:
+			batch = append(batch, sample)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// restoreState restores the samples saved in the state file, then saves them
+// periodically and when the exporter is stopped.
+func restoreState(path string, interval time.Duration) {
+	restored, err := sampleCollector.Restore(path)
+	if err != nil {
+		log.Errorf("Failed to restore state from %s: %v", path, err)
+	} else {
+		log.Infof("Restored %d samples from %s", restored, path)
+	}
+
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				saveState(path)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, saving state", sig)
+		saveState(path)
+		os.Exit(0)
+	}()
+}
+
+// saveState saves the samples to the state file.
+func saveState(path string) {
+	saved, err := sampleCollector.Save(path)
+	if err != nil {
+		log.Errorf("Failed to save state to %s: %v", path, err)
+		return
+	}
+	log.Debugf("Saved %d samples to %s", saved, path)
+}
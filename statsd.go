@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+	"github.com/sbouchex/mqtt_exporter/config"
+)
+
+const (
+	statsdTagFormatDogStatsD = "dogstatsd"
+	statsdTagFormatInflux    = "influx"
+)
+
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "=", "_", " ", "_", "\n", "_")
+
+// statsdWriter forwards the samples as StatsD gauges, counters being sent as
+// increments since the previous sample.
+type statsdWriter struct {
+	cfg      config.ExporterStatsDConfig
+	conn     net.Conn
+	counters map[string]float64
+}
+
+// startStatsD adds a sink forwarding the samples to a StatsD server over UDP.
+func startStatsD(cfg config.ExporterStatsDConfig) error {
+	if cfg.TagFormat != statsdTagFormatDogStatsD && cfg.TagFormat != statsdTagFormatInflux {
+		return fmt.Errorf("Wrong statsd tagFormat value: %s", cfg.TagFormat)
+	}
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	w := &statsdWriter{cfg: cfg, conn: conn, counters: map[string]float64{}}
+	log.Infof("Forwarding samples to StatsD %s", cfg.Address)
+	sampleSinks = append(sampleSinks, newBatchSink("statsd", cfg.BatchSize, cfg.FlushInterval, w.write))
+	return nil
+}
+
+// write sends the samples, packing lines in packets of at most MaxPacketSize
+// bytes.
+func (w *statsdWriter) write(samples []timedSample) error {
+	var packet bytes.Buffer
+	var err error
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, e := w.conn.Write(packet.Bytes()); e != nil {
+			err = e
+		}
+		packet.Reset()
+	}
+	for _, v := range samples {
+		for _, line := range w.lines(v.sample) {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > w.cfg.MaxPacketSize {
+				flush()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	flush()
+	return err
+}
+
+// lines returns the StatsD lines of a sample.
+func (w *statsdWriter) lines(sample *collector.Sample) []string {
+	if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		return nil
+	}
+
+	keys := make([]string, 0, len(sample.Labels))
+	for k := range sample.Labels {
+		if sample.Labels[k] != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		separator := ":"
+		if w.cfg.TagFormat == statsdTagFormatInflux {
+			separator = "="
+		}
+		tags = append(tags, statsdEscaper.Replace(k)+separator+statsdEscaper.Replace(sample.Labels[k]))
+	}
+
+	name := statsdEscaper.Replace(w.cfg.Prefix + sample.Name)
+	suffix := ""
+	if len(tags) > 0 {
+		if w.cfg.TagFormat == statsdTagFormatInflux {
+			name += "," + strings.Join(tags, ",")
+		} else {
+			suffix = "|#" + strings.Join(tags, ",")
+		}
+	}
+	format := func(value float64, metricType string) string {
+		return name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + metricType + suffix
+	}
+
+	if sample.Type == prometheus.CounterValue {
+		previous, ok := w.counters[sample.Id]
+		w.counters[sample.Id] = sample.Value
+		if !ok || sample.Value < previous {
+			// First sample or counter reset
+			return nil
+		}
+		return []string{format(sample.Value-previous, "c")}
+	}
+	if sample.Value < 0 {
+		// A signed gauge value is a relative change, reset the gauge first
+		return []string{format(0, "g"), format(sample.Value, "g")}
+	}
+	return []string{format(sample.Value, "g")}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/config"
+	"github.com/sbouchex/mqtt_exporter/decoder"
+)
+
+// exporterStatus is the document published on the status topic.
+type exporterStatus struct {
+	Connected         bool    `json:"connected"`
+	Version           string  `json:"version"`
+	Hostname          string  `json:"hostname,omitempty"`
+	Timestamp         int64   `json:"timestamp"`
+	Uptime            int64   `json:"uptime"`
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	MessagesReceived  float64 `json:"messagesReceived"`
+	ActiveSeries      int64   `json:"activeSeries"`
+}
+
+// statusWill returns the payload published by the broker on the status topic
+// when the exporter disconnects unexpectedly.
+func statusWill() string {
+	payload, _ := json.Marshal(exporterStatus{Connected: false, Version: version})
+	return string(payload)
+}
+
+// publishStatus periodically publishes the status of the exporter.
+func publishStatus(client mqtt.Client, cfg config.ExporterMqttConfig) {
+	hostname, _ := os.Hostname()
+	started := time.Now()
+	last := time.Now()
+	lastReceived := counterValue(decoder.ReceivedMessages)
+
+	log.Infof("Publishing status to topic %s every %s", cfg.StatusTopic, cfg.StatusInterval)
+	for now := range time.Tick(cfg.StatusInterval) {
+		received := counterValue(decoder.ReceivedMessages)
+		status := exporterStatus{
+			Connected:         client.IsConnectionOpen(),
+			Version:           version,
+			Hostname:          hostname,
+			Timestamp:         now.Unix(),
+			Uptime:            int64(now.Sub(started).Seconds()),
+			MessagesPerSecond: (received - lastReceived) / now.Sub(last).Seconds(),
+			MessagesReceived:  received,
+			ActiveSeries:      sampleCollector.Count(),
+		}
+		last, lastReceived = now, received
+
+		payload, err := json.Marshal(status)
+		if err != nil {
+			log.Errorf("Failed to encode status: %v", err)
+			continue
+		}
+		if !status.Connected {
+			continue
+		}
+		token := client.Publish(cfg.StatusTopic, cfg.Qos, cfg.StatusRetain, payload)
+		if token.WaitTimeout(cfg.StatusInterval) && token.Error() != nil {
+			log.Errorf("Failed to publish status: %v", token.Error())
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// sdNotify sends a state to the systemd notification socket, when running as
+// a Type=notify service.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// startWatchdog pings the systemd watchdog, when WatchdogSec is set, as long
+// as the MQTT connection is open so that a wedged exporter gets restarted.
+func startWatchdog(client mqtt.Client) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Infof("Pinging the systemd watchdog every %s", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if client.IsConnectionOpen() {
+				sdNotify("WATCHDOG=1")
+			} else {
+				log.Warn("MQTT connection down, not pinging the systemd watchdog")
+			}
+		}
+	}()
+}
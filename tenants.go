@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// tenantMetricsHandler serves the metrics of the tenants having their own
+// metrics path (<metricsPath>/<tenant>).
+func tenantMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(exporterConfig.Config.MetricsPath, "/")+"/")
+	tenant, ok := messageDecoder.Configuration().Tenants[name]
+	if !ok || !tenant.SeparateMetricsPath {
+		http.NotFound(w, r)
+		return
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(sampleCollector.Tenant(name))
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/sbouchex/mqtt_exporter/collector"
+)
+
+// recordingSink keeps the last sample of each series.
+type recordingSink struct {
+	mu      sync.Mutex
+	samples map[string]*collector.Sample
+}
+
+func (s *recordingSink) send(sample *collector.Sample, received time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[sample.Id] = sample
+}
+
+// runTest runs a message read from --payload-file through the configured
+// filters and prints the resulting metrics in the exposition format. It
+// returns the exit code: 1 when no metric is produced.
+func runTest() int {
+	if *testTopic == "" || *testPayloadFile == "" {
+		log.Fatal("The test command requires --topic and --payload-file")
+	}
+	var payload []byte
+	var err error
+	if *testPayloadFile == "-" {
+		payload, err = io.ReadAll(os.Stdin)
+	} else {
+		payload, err = os.ReadFile(*testPayloadFile)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read payload file %s: %v", *testPayloadFile, err)
+	}
+
+	initExporter()
+	sink := &recordingSink{samples: map[string]*collector.Sample{}}
+	sampleSinks = append(sampleSinks, sink)
+
+	messageDecoder.Dispatch(&replayMessage{topic: *testTopic, payload: payload})
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.samples) == 0 {
+		log.Warnf("No metric produced for topic %s", *testTopic)
+		return 1
+	}
+	writeExposition(os.Stdout, sink.samples)
+	return 0
+}
+
+// writeExposition writes the samples in the Prometheus text exposition format,
+// sorted by metric name.
+func writeExposition(w io.Writer, samples map[string]*collector.Sample) {
+	byName := map[string][]*collector.Sample{}
+	for _, sample := range samples {
+		byName[sample.Name] = append(byName[sample.Name], sample)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := byName[name]
+		lines := make([]string, 0, len(family))
+		for _, sample := range family {
+			lines = append(lines, sampleLine(sample))
+		}
+		sort.Strings(lines)
+
+		metricType := "gauge"
+		if family[0].Type == prometheus.CounterValue {
+			metricType = "counter"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", name, family[0].Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}